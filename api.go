@@ -1,6 +1,9 @@
 package ydb
 
-import "go.uber.org/zap"
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
 
 type Logger interface {
 	NamedLogger(name string) *zap.Logger
@@ -10,3 +13,7 @@ type Configurer interface {
 	UnmarshalKey(name string, out any) error
 	Has(name string) bool
 }
+
+type Tracer interface {
+	Tracer() *sdktrace.TracerProvider
+}
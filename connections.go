@@ -0,0 +1,223 @@
+package ydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/retailcrm/roadrunner-ydb/ydbjobs"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/balancers"
+	"github.com/ydb-platform/ydb-go-sdk/v3/config"
+	"github.com/ydb-platform/ydb-go-sdk/v3/retry/budget"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"sync"
+)
+
+// connections shares YDB drivers between pipelines with the same endpoint and credentials.
+// A driver is closed when the last pipeline using it releases it or when the plugin stops.
+type connections struct {
+	mu    sync.Mutex
+	conns map[string]*connection
+	open  func(cfg ydbjobs.Config) (*ydb.Driver, error)
+}
+
+// connection is added before the driver is opened, pipelines acquiring it meanwhile wait for ready.
+type connection struct {
+	driver *ydb.Driver
+	refs   int
+	ready  chan struct{}
+	// err is set when the driver failed to open
+	err error
+}
+
+var errConnectionsClosed = errors.New("connections are closed, the plugin is stopped")
+
+func newConnections() *connections {
+	return &connections{
+		conns: make(map[string]*connection),
+		open:  connect,
+	}
+}
+
+func connectionKey(cfg ydbjobs.Config) (string, error) {
+	key, err := json.Marshal(struct {
+		Endpoint          string
+		StaticCredentials *ydbjobs.StaticCredentials
+		Auth              *ydbjobs.Auth
+		TLS               *ydbjobs.TLS
+		Connection        *ydbjobs.Connection
+	}{
+		Endpoint:          cfg.Endpoint,
+		StaticCredentials: cfg.StaticCredentials,
+		Auth:              cfg.Auth,
+		TLS:               cfg.TLS,
+		Connection:        cfg.Connection,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// acquire returns the shared driver for the configuration and the function releasing it. The driver is opened
+// without holding the lock, so a slow endpoint doesn't block pipelines of other connections.
+func (c *connections) acquire(cfg ydbjobs.Config) (*ydb.Driver, func(context.Context) error, error) {
+	key, err := connectionKey(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+
+	conn, ok := c.conns[key]
+	if !ok {
+		conn = &connection{ready: make(chan struct{})}
+		c.conns[key] = conn
+	}
+
+	conn.refs++
+	c.mu.Unlock()
+
+	if !ok {
+		c.openConnection(cfg, key, conn)
+	}
+
+	<-conn.ready
+	if conn.err != nil {
+		return nil, nil, conn.err
+	}
+
+	var once sync.Once
+	release := func(ctx context.Context) error {
+		var err error
+		once.Do(func() {
+			err = c.release(ctx, key, conn)
+		})
+
+		return err
+	}
+
+	return conn.driver, release, nil
+}
+
+// openConnection opens the driver of the pending connection and wakes up the pipelines waiting for it.
+// A failed connection is removed, so the next pipeline opens it again.
+func (c *connections) openConnection(cfg ydbjobs.Config, key string, conn *connection) {
+	driver, err := c.open(cfg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer close(conn.ready)
+
+	if err == nil && c.conns[key] != conn {
+		// removed by the plugin stop while opening
+		err = errors.Join(errConnectionsClosed, driver.Close(context.Background()))
+	}
+
+	if err != nil {
+		conn.err = err
+		if c.conns[key] == conn {
+			delete(c.conns, key)
+		}
+
+		return
+	}
+
+	conn.driver = driver
+}
+
+func (c *connections) release(ctx context.Context, key string, conn *connection) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// already closed by the plugin stop
+	if c.conns[key] != conn {
+		return nil
+	}
+
+	conn.refs--
+	if conn.refs > 0 {
+		return nil
+	}
+
+	delete(c.conns, key)
+
+	return conn.driver.Close(ctx)
+}
+
+func (c *connections) closeAll(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for key, conn := range c.conns {
+		delete(c.conns, key)
+
+		// a connection being opened is closed once it is open
+		if conn.driver == nil {
+			continue
+		}
+
+		if err := conn.driver.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func connect(cfg ydbjobs.Config) (*ydb.Driver, error) {
+	options := connectionOptions(cfg.Connection)
+
+	if cfg.StaticCredentials != nil {
+		options = append(
+			options,
+			ydb.WithStaticCredentials(cfg.StaticCredentials.User, cfg.StaticCredentials.Password),
+		)
+	}
+
+	if cfg.Auth != nil {
+		options = append(options, credentialsOption(cfg.Auth))
+	}
+
+	if cfg.TLS != nil && cfg.TLS.Ca != "" {
+		options = append(options, ydb.WithCertificatesFromFile(cfg.TLS.Ca))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Connection.OpenTimeout)
+	defer cancel()
+
+	return ydb.Open(ctx, cfg.Endpoint, options...)
+}
+
+func connectionOptions(conn *ydbjobs.Connection) []ydb.Option {
+	options := []ydb.Option{
+		ydb.WithDialTimeout(conn.DialTimeout),
+		ydb.WithConnectionTTL(conn.ConnectionTTL),
+	}
+
+	if !conn.AutoRetry {
+		options = append(options, ydb.With(config.WithNoAutoRetry()))
+	} else if conn.RetryBudget > 0 {
+		options = append(options, ydb.WithRetryBudget(budget.Percent(conn.RetryBudget)))
+	}
+
+	switch conn.Balancer {
+	case ydbjobs.BalancerRandom:
+		options = append(options, ydb.WithBalancer(balancers.RandomChoice()))
+	case ydbjobs.BalancerLocalDC:
+		options = append(options, ydb.WithBalancer(balancers.PreferLocalDCWithFallBack(balancers.RandomChoice())))
+	}
+
+	if conn.Keepalive != nil {
+		options = append(options, ydb.With(config.WithGrpcOptions(grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                conn.Keepalive.Time,
+			Timeout:             conn.Keepalive.Timeout,
+			PermitWithoutStream: conn.Keepalive.PermitWithoutStream,
+		}))))
+	}
+
+	return options
+}
@@ -0,0 +1,90 @@
+package ydb
+
+import (
+	"github.com/retailcrm/roadrunner-ydb/ydbjobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionsOpenOutsideLock(t *testing.T) {
+	unblock := make(chan struct{})
+
+	var slowOpens atomic.Int32
+
+	c := newConnections()
+	c.open = func(cfg ydbjobs.Config) (*ydb.Driver, error) {
+		if cfg.Endpoint == "grpc://slow" {
+			slowOpens.Add(1)
+			<-unblock
+		}
+
+		return new(ydb.Driver), nil
+	}
+
+	slow := ydbjobs.Config{Endpoint: "grpc://slow", Connection: &ydbjobs.Connection{}}
+	fast := ydbjobs.Config{Endpoint: "grpc://fast", Connection: &ydbjobs.Connection{}}
+
+	drivers := make([]*ydb.Driver, 2)
+
+	var wg sync.WaitGroup
+	for i := range drivers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			driver, _, err := c.acquire(slow)
+			assert.NoError(t, err)
+			drivers[i] = driver
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_, _, err := c.acquire(fast)
+		assert.NoError(t, err)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("opening a connection blocks the other connections")
+	}
+
+	close(unblock)
+	wg.Wait()
+
+	require.NotNil(t, drivers[0])
+	assert.Same(t, drivers[0], drivers[1], "the pipelines share the driver")
+
+	assert.Equal(t, int32(1), slowOpens.Load())
+}
+
+func TestConnectionsOpenFailure(t *testing.T) {
+	var opens atomic.Int32
+
+	c := newConnections()
+	c.open = func(ydbjobs.Config) (*ydb.Driver, error) {
+		opens.Add(1)
+
+		return nil, assert.AnError
+	}
+
+	cfg := ydbjobs.Config{Endpoint: "grpc://broken", Connection: &ydbjobs.Connection{}}
+
+	_, _, err := c.acquire(cfg)
+	assert.ErrorIs(t, err, assert.AnError)
+
+	_, _, err = c.acquire(cfg)
+	assert.ErrorIs(t, err, assert.AnError)
+
+	assert.Equal(t, int32(2), opens.Load(), "a failed connection is opened again")
+	assert.Empty(t, c.conns)
+}
@@ -0,0 +1,243 @@
+package ydb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/retailcrm/roadrunner-ydb/ydbjobs"
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/credentials"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokens are refreshed this long before they expire
+	tokenRefreshMargin  = 5 * time.Minute
+	tokenRequestTimeout = 10 * time.Second
+)
+
+// tokenClient requests IAM tokens, it doesn't share the transport with the application.
+var tokenClient = &http.Client{Timeout: tokenRequestTimeout}
+
+// credentialsOption maps the auth configuration onto the corresponding SDK credentials option.
+func credentialsOption(auth *ydbjobs.Auth) ydb.Option {
+	switch {
+	case auth.AccessToken != "":
+		return ydb.WithAccessTokenCredentials(auth.AccessToken)
+	case auth.AccessTokenFile != "":
+		return ydb.WithCredentials(&tokenFileCredentials{path: auth.AccessTokenFile})
+	case auth.OAuth2 != nil && auth.OAuth2.ConfigFile != "":
+		return ydb.WithOauth2TokenExchangeCredentialsFile(auth.OAuth2.ConfigFile)
+	case auth.OAuth2 != nil:
+		return ydb.WithOauth2TokenExchangeCredentials(oauth2Options(auth.OAuth2)...)
+	case auth.ServiceAccountKeyFile != "":
+		return ydb.WithCreateCredentialsFunc(func(context.Context) (credentials.Credentials, error) {
+			return newServiceAccountKeyCredentials(auth.ServiceAccountKeyFile, auth.IAMEndpoint)
+		})
+	default:
+		return ydb.WithCredentials(&refreshingCredentials{fetch: metadataToken(auth.MetadataEndpoint)})
+	}
+}
+
+func oauth2Options(cfg *ydbjobs.OAuth2) []credentials.Oauth2TokenExchangeCredentialsOption {
+	opts := []credentials.Oauth2TokenExchangeCredentialsOption{
+		credentials.WithTokenEndpoint(cfg.TokenEndpoint),
+	}
+
+	if len(cfg.Audience) > 0 {
+		opts = append(opts, credentials.WithAudience(cfg.Audience[0], cfg.Audience[1:]...))
+	}
+
+	if len(cfg.Scope) > 0 {
+		opts = append(opts, credentials.WithScope(cfg.Scope[0], cfg.Scope[1:]...))
+	}
+
+	if len(cfg.Resource) > 0 {
+		opts = append(opts, credentials.WithResource(cfg.Resource[0], cfg.Resource[1:]...))
+	}
+
+	if cfg.SubjectToken != "" {
+		opts = append(opts, credentials.WithFixedSubjectToken(cfg.SubjectToken, cfg.SubjectTokenType))
+	}
+
+	return opts
+}
+
+// tokenFileCredentials reads the access token from the file and re-reads it when the file is modified.
+type tokenFileCredentials struct {
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+func (c *tokenFileCredentials) Token(_ context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return "", err
+	}
+
+	if c.token != "" && info.ModTime().Equal(c.modTime) {
+		return c.token, nil
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.Errorf("access token file is empty: %s", c.path)
+	}
+
+	c.token = token
+	c.modTime = info.ModTime()
+
+	return c.token, nil
+}
+
+// refreshingCredentials caches the token until it is about to expire.
+type refreshingCredentials struct {
+	fetch func(ctx context.Context) (string, time.Time, error)
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (c *refreshingCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expiresAt) > tokenRefreshMargin {
+		return c.token, nil
+	}
+
+	token, expiresAt, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	c.token = token
+	c.expiresAt = expiresAt
+
+	return c.token, nil
+}
+
+type serviceAccountKey struct {
+	ID               string `json:"id"`
+	ServiceAccountID string `json:"service_account_id"`
+	PrivateKey       string `json:"private_key"`
+}
+
+// newServiceAccountKeyCredentials exchanges a JWT signed with the service account key for an IAM token,
+// the JWT is issued by the SDK token source.
+func newServiceAccountKeyCredentials(path string, endpoint string) (credentials.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key serviceAccountKey
+	err = json.Unmarshal(data, &key)
+	if err != nil {
+		return nil, errors.Errorf("failed to parse service account key file %s: %v", path, err)
+	}
+
+	source, err := credentials.NewJWTTokenSource(
+		credentials.WithSigningMethodName("PS256"),
+		credentials.WithRSAPrivateKeyPEMContent([]byte(key.PrivateKey)),
+		credentials.WithKeyID(key.ID),
+		credentials.WithIssuer(key.ServiceAccountID),
+		credentials.WithAudience(endpoint),
+		credentials.WithTokenTTL(time.Hour),
+	)
+	if err != nil {
+		return nil, errors.Errorf("failed to load service account key %s: %v", path, err)
+	}
+
+	return &refreshingCredentials{
+		fetch: func(ctx context.Context) (string, time.Time, error) {
+			jwt, err := source.Token()
+			if err != nil {
+				return "", time.Time{}, err
+			}
+
+			body, err := json.Marshal(map[string]string{"jwt": jwt.Token})
+			if err != nil {
+				return "", time.Time{}, err
+			}
+
+			var resp struct {
+				IamToken  string    `json:"iamToken"`
+				ExpiresAt time.Time `json:"expiresAt"`
+			}
+
+			err = requestToken(ctx, http.MethodPost, endpoint, bytes.NewReader(body), nil, &resp)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+
+			return resp.IamToken, resp.ExpiresAt, nil
+		},
+	}, nil
+}
+
+// metadataToken gets the token of the service account attached to the VM from the metadata service.
+func metadataToken(endpoint string) func(ctx context.Context) (string, time.Time, error) {
+	return func(ctx context.Context) (string, time.Time, error) {
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+
+		err := requestToken(ctx, http.MethodGet, endpoint, nil, map[string]string{"Metadata-Flavor": "Google"}, &resp)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+
+		return resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+	}
+}
+
+func requestToken(ctx context.Context, method, url string, body io.Reader, headers map[string]string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("token request to %s failed with status %d: %s", url, resp.StatusCode, data)
+	}
+
+	return json.Unmarshal(data, out)
+}
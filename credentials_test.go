@@ -0,0 +1,153 @@
+package ydb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServiceAccountKeyCredentials(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustMarshalPKCS8(t, privateKey)})
+
+	data, err := json.Marshal(serviceAccountKey{ID: "key-id", ServiceAccountID: "sa-id", PrivateKey: string(keyPEM)})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	var requests atomic.Int32
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		var body struct {
+			JWT string `json:"jwt"`
+		}
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&body)) {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		claims := &jwt.RegisteredClaims{}
+		token, err := jwt.ParseWithClaims(body.JWT, claims, func(*jwt.Token) (any, error) {
+			return &privateKey.PublicKey, nil
+		})
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		assert.Equal(t, "PS256", token.Method.Alg())
+		assert.Equal(t, "key-id", token.Header["kid"])
+		assert.Equal(t, "sa-id", claims.Issuer)
+		assert.True(t, claims.VerifyAudience(server.URL, true))
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"iamToken":  "iam-token",
+			"expiresAt": time.Now().Add(time.Hour),
+		})
+	}))
+	defer server.Close()
+
+	creds, err := newServiceAccountKeyCredentials(path, server.URL)
+	require.NoError(t, err)
+
+	for range 2 {
+		token, err := creds.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "iam-token", token)
+	}
+
+	assert.Equal(t, int32(1), requests.Load(), "the token is cached until it is about to expire")
+}
+
+func TestMetadataCredentials(t *testing.T) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if r.URL.Path != "/" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		// the token is about to expire, so it is requested every time
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "vm-token", "expires_in": 60})
+	}))
+	defer server.Close()
+
+	creds := &refreshingCredentials{fetch: metadataToken(server.URL)}
+
+	for range 2 {
+		token, err := creds.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "vm-token", token)
+	}
+
+	assert.Equal(t, int32(2), requests.Load())
+
+	creds = &refreshingCredentials{fetch: metadataToken(server.URL + "/missing")}
+
+	_, err := creds.Token(context.Background())
+	assert.ErrorContains(t, err, "failed with status 404")
+}
+
+func TestTokenFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+
+	creds := &tokenFileCredentials{path: path}
+
+	token, err := creds.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "first", token)
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	token, err = creds.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "second", token)
+
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+
+	_, err = creds.Token(context.Background())
+	assert.Error(t, err)
+}
+
+func mustMarshalPKCS8(t *testing.T, key *rsa.PrivateKey) []byte {
+	t.Helper()
+
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	return data
+}
@@ -3,13 +3,16 @@ package ydb
 import (
 	"context"
 	"encoding/json"
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/retailcrm/roadrunner-ydb/ydbjobs"
 	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"github.com/roadrunner-server/endure/v2/dep"
 	"github.com/roadrunner-server/errors"
-	"github.com/ydb-platform/ydb-go-sdk/v3"
-	"github.com/ydb-platform/ydb-go-sdk/v3/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
-	"time"
+	"sync"
 )
 
 const (
@@ -19,13 +22,23 @@ const (
 const (
 	priorityKey        string = "priority"
 	topicKey           string = "topic"
+	producerKey        string = "producer"
 	producerOptionsKey string = "producer_options"
 	consumerOptionsKey string = "consumer_options"
+	declareKey         string = "declare"
 )
 
 type Plugin struct {
-	logger *zap.Logger
-	cfg    Configurer
+	logger  *zap.Logger
+	cfg     Configurer
+	metrics *ydbjobs.Metrics
+	tracer  trace.TracerProvider
+
+	connections *connections
+
+	mu sync.RWMutex
+	// drivers of the running pipelines by the pipeline name, used by the RPC
+	drivers map[string]*ydbjobs.Driver
 }
 
 func (p *Plugin) Init(log Logger, cfg Configurer) error {
@@ -35,16 +48,57 @@ func (p *Plugin) Init(log Logger, cfg Configurer) error {
 
 	p.logger = log.NamedLogger(pluginName)
 	p.cfg = cfg
+	p.metrics = ydbjobs.NewMetrics()
+	p.tracer = otel.GetTracerProvider()
+	p.connections = newConnections()
+	p.drivers = make(map[string]*ydbjobs.Driver)
 
 	p.logger.Info("ydb plugin initialized")
 
 	return nil
 }
 
+func (p *Plugin) Serve() chan error {
+	return make(chan error, 1)
+}
+
+// Stop closes connections left open by pipelines that were not stopped.
+func (p *Plugin) Stop(ctx context.Context) error {
+	return p.connections.closeAll(ctx)
+}
+
 func (p *Plugin) Name() string {
 	return pluginName
 }
 
+func (p *Plugin) Collects() []*dep.In {
+	return []*dep.In{
+		dep.Fits(func(pp any) {
+			p.tracer = pp.(Tracer).Tracer()
+		}, (*Tracer)(nil)),
+	}
+}
+
+func (p *Plugin) MetricsCollector() []prometheus.Collector {
+	return p.metrics.Collectors()
+}
+
+func (p *Plugin) RPC() any {
+	return &rpc{plugin: p}
+}
+
+func (p *Plugin) driver(pipeline string) (*ydbjobs.Driver, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	d, ok := p.drivers[pipeline]
+	if !ok {
+		return nil, errors.Errorf("no such ydb pipeline: %s", pipeline)
+	}
+
+	return d, nil
+}
+
 func (p *Plugin) DriverFromConfig(configKey string, queue jobs.Queue, pipeline jobs.Pipeline) (jobs.Driver, error) {
 	p.logger.Debug("start driver from config")
 
@@ -72,7 +126,7 @@ func (p *Plugin) DriverFromConfig(configKey string, queue jobs.Queue, pipeline j
 		zap.String("topic", cfg.Topic),
 	)
 
-	return open(cfg, queue, pipeline, p.logger)
+	return p.open(cfg, queue, pipeline)
 }
 
 func (p *Plugin) DriverFromPipeline(pipeline jobs.Pipeline, queue jobs.Queue) (jobs.Driver, error) {
@@ -94,10 +148,15 @@ func (p *Plugin) DriverFromPipeline(pipeline jobs.Pipeline, queue jobs.Queue) (j
 		return nil, errors.E("no topic specified")
 	}
 
-	var pOpt *ydbjobs.ProducerOpts
+	if pipeline.Has(producerKey) {
+		producer := pipeline.Bool(producerKey, true)
+		cfg.Producer = &producer
+	}
+
 	producerOpts := pipeline.String(producerOptionsKey, "")
 	if producerOpts != "" {
-		err = json.Unmarshal([]byte(producerOpts), &pOpt)
+		pOpt := &ydbjobs.ProducerOpts{}
+		err = decodeOptions(producerOpts, pOpt)
 		if err != nil {
 			return nil, err
 		}
@@ -105,10 +164,10 @@ func (p *Plugin) DriverFromPipeline(pipeline jobs.Pipeline, queue jobs.Queue) (j
 		cfg.ProducerOpts = pOpt
 	}
 
-	var cOpt *ydbjobs.ConsumerOpts
 	consumerOpts := pipeline.String(consumerOptionsKey, "")
 	if consumerOpts != "" {
-		err = json.Unmarshal([]byte(consumerOpts), &cOpt)
+		cOpt := &ydbjobs.ConsumerOpts{}
+		err = decodeOptions(consumerOpts, cOpt)
 		if err != nil {
 			return nil, err
 		}
@@ -116,49 +175,84 @@ func (p *Plugin) DriverFromPipeline(pipeline jobs.Pipeline, queue jobs.Queue) (j
 		cfg.ConsumerOpts = cOpt
 	}
 
+	declare := pipeline.String(declareKey, "")
+	if declare != "" {
+		dOpt := &ydbjobs.Declare{}
+		err = decodeOptions(declare, dOpt)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Declare = dOpt
+	}
+
 	p.logger.Info("creating ydb driver from pipeline",
 		zap.String("pipeline", pipeline.Name()),
 		zap.String("topic", cfg.Topic),
 	)
 
-	return open(cfg, queue, pipeline, p.logger)
+	return p.open(cfg, queue, pipeline)
 }
 
-func open(cfg ydbjobs.Config, queue jobs.Queue, pipeline jobs.Pipeline, logger *zap.Logger) (jobs.Driver, error) {
-	options := []ydb.Option{
-		ydb.With(config.WithNoAutoRetry()),
-		ydb.WithDialTimeout(time.Second * 5),
-		ydb.WithConnectionTTL(time.Second * 30),
+// decodeOptions decodes JSON pipeline options using the same keys and value formats
+// (e.g. durations like "5s") as the YAML configuration.
+func decodeOptions(data string, out any) error {
+	var raw map[string]any
+	err := json.Unmarshal([]byte(data), &raw)
+	if err != nil {
+		return err
 	}
 
-	if cfg.StaticCredentials != nil {
-		options = append(
-			options,
-			ydb.WithStaticCredentials(cfg.StaticCredentials.User, cfg.StaticCredentials.Password),
-		)
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
 	}
 
-	if cfg.TLS != nil && cfg.TLS.Ca != "" {
-		options = append(options, ydb.WithCertificatesFromFile(cfg.TLS.Ca))
-	}
+	return decoder.Decode(raw)
+}
+
+func (p *Plugin) open(cfg ydbjobs.Config, queue jobs.Queue, pipeline jobs.Pipeline) (jobs.Driver, error) {
+	cfg.InitDefaults()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
 
-	driver, err := ydb.Open(ctx, cfg.Endpoint, options...)
+	driver, release, err := p.connections.acquire(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	d := &ydbjobs.Driver{
-		Cfg:    cfg,
-		Driver: driver,
-		Client: driver.Topic(),
-		Queue:  queue,
-		Logger: logger,
+		Cfg:     cfg,
+		Driver:  driver,
+		Client:  driver.Topic(),
+		Queue:   queue,
+		Logger:  p.logger,
+		Metrics: p.metrics,
+		Tracer:  p.tracer,
+	}
+
+	d.Release = func(ctx context.Context) error {
+		p.mu.Lock()
+		if p.drivers[pipeline.Name()] == d {
+			delete(p.drivers, pipeline.Name())
+		}
+		p.mu.Unlock()
+
+		return release(ctx)
 	}
 
 	d.Pipeline.Store(&pipeline)
 
+	p.mu.Lock()
+	p.drivers[pipeline.Name()] = d
+	p.mu.Unlock()
+
 	return d, nil
 }
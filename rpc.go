@@ -0,0 +1,468 @@
+package ydb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/retailcrm/roadrunner-ydb/ydbjobs"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
+	"math"
+	"time"
+)
+
+const (
+	rpcTimeout = 30 * time.Second
+)
+
+type rpc struct {
+	plugin *Plugin
+}
+
+type Job struct {
+	Job      string              `json:"job"`
+	ID       string              `json:"id"`
+	Payload  string              `json:"payload"`
+	Headers  map[string][]string `json:"headers"`
+	Priority int64               `json:"priority"`
+	Delay    int64               `json:"delay"`
+	AutoAck  bool                `json:"auto_ack"`
+}
+
+type PushBatchRequest struct {
+	Pipeline string `json:"pipeline"`
+	Jobs     []*Job `json:"jobs"`
+}
+
+type PushBatchResponse struct {
+	Failed []FailedJob `json:"failed"`
+}
+
+type FailedJob struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// PushBatch writes the jobs to the pipeline topic in a single call. Jobs that were not pushed are listed
+// in the response, the call fails only when the whole batch can't be handled.
+func (r *rpc) PushBatch(in *PushBatchRequest, out *PushBatchResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := r.messages(d, in.Pipeline, in.Jobs)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	err = d.PushBatch(ctx, msgs)
+
+	var batchErr *ydbjobs.BatchError
+	if errors.As(err, &batchErr) {
+		for _, failed := range batchErr.Failed {
+			out.Failed = append(out.Failed, FailedJob{ID: failed.ID, Error: failed.Err.Error()})
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+type PushTxRequest struct {
+	Pipeline string `json:"pipeline"`
+	// Query is the optional YQL statement executed in the same transaction
+	Query string `json:"query"`
+	// Params are the query parameters by name including the $ prefix,
+	// integral numbers are passed as Int64, other numbers as Double
+	Params map[string]any `json:"params"`
+	Jobs   []*Job         `json:"jobs"`
+}
+
+type PushTxResponse struct{}
+
+// PushTx runs the query and writes the jobs to the pipeline topic in one transaction,
+// the jobs are enqueued only if the transaction commits.
+func (r *rpc) PushTx(in *PushTxRequest, _ *PushTxResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := r.messages(d, in.Pipeline, in.Jobs)
+	if err != nil {
+		return err
+	}
+
+	params := ydb.ParamsFromMap(normalizeParams(in.Params))
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	return d.Driver.Query().DoTx(ctx, func(ctx context.Context, tx query.TxActor) error {
+		if in.Query != "" {
+			err := tx.Exec(ctx, in.Query, query.WithParameters(params))
+			if err != nil {
+				return err
+			}
+		}
+
+		return d.PushTx(ctx, tx, msgs)
+	})
+}
+
+type AttachAckRequest struct {
+	Pipeline string `json:"pipeline"`
+	// ID is the ID of the job being processed
+	ID     string         `json:"id"`
+	Query  string         `json:"query"`
+	Params map[string]any `json:"params"`
+}
+
+type AttachAckResponse struct{}
+
+// AttachAck adds the query to the transaction that commits the offset of the job in the tx consumer mode.
+// It must be called before the job is acknowledged, the query is executed when all jobs of the transaction are acked.
+func (r *rpc) AttachAck(in *AttachAckRequest, _ *AttachAckResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	return d.AttachAck(in.ID, in.Query, query.WithParameters(ydb.ParamsFromMap(normalizeParams(in.Params))))
+}
+
+type SeekRequest struct {
+	Pipeline string `json:"pipeline"`
+	// ReadFrom is an RFC 3339 timestamp the consumer is moved to
+	ReadFrom string            `json:"read_from"`
+	Offsets  []PartitionOffset `json:"offsets"`
+}
+
+type PartitionOffset struct {
+	// Topic defaults to the pipeline topic
+	Topic     string `json:"topic"`
+	Partition int64  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+type SeekResponse struct{}
+
+// Seek pauses the pipeline, moves its consumer to the timestamp or to the partition offsets and resumes it,
+// the jobs after the new position are processed again.
+func (r *rpc) Seek(in *SeekRequest, _ *SeekResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	var readFrom time.Time
+	if in.ReadFrom != "" {
+		readFrom, err = time.Parse(time.RFC3339, in.ReadFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	offsets := make([]ydbjobs.PartitionOffset, len(in.Offsets))
+	for i, offset := range in.Offsets {
+		offsets[i] = ydbjobs.PartitionOffset(offset)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	return d.Seek(ctx, in.Pipeline, readFrom, offsets)
+}
+
+type TopicRequest struct {
+	Pipeline string `json:"pipeline"`
+	// Topic defaults to the pipeline topic
+	Topic string `json:"topic"`
+}
+
+type DescribeTopicResponse struct {
+	Path       string      `json:"path"`
+	Partitions []Partition `json:"partitions"`
+	// RetentionPeriod is in seconds
+	RetentionPeriod int64      `json:"retention_period"`
+	Codecs          []string   `json:"codecs"`
+	Consumers       []Consumer `json:"consumers"`
+}
+
+type Partition struct {
+	ID             int64 `json:"id"`
+	Active         bool  `json:"active"`
+	StartOffset    int64 `json:"start_offset"`
+	EndOffset      int64 `json:"end_offset"`
+	StoreSizeBytes int64 `json:"store_size_bytes"`
+	// LastWriteTime is an RFC 3339 timestamp, empty when nothing was written
+	LastWriteTime string `json:"last_write_time"`
+}
+
+type Consumer struct {
+	Name       string              `json:"name"`
+	Important  bool                `json:"important"`
+	Lag        int64               `json:"lag"`
+	Partitions []ConsumerPartition `json:"partitions"`
+}
+
+type ConsumerPartition struct {
+	ID              int64  `json:"id"`
+	CommittedOffset int64  `json:"committed_offset"`
+	LastReadOffset  int64  `json:"last_read_offset"`
+	Lag             int64  `json:"lag"`
+	ReaderName      string `json:"reader_name"`
+}
+
+// DescribeTopic returns the partitions, retention, codecs and consumers of the topic
+// with committed offsets and lag of every consumer.
+func (r *rpc) DescribeTopic(in *TopicRequest, out *DescribeTopicResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	info, err := d.DescribeTopic(ctx, in.Topic)
+	if err != nil {
+		return err
+	}
+
+	out.Path = info.Path
+	out.RetentionPeriod = int64(info.RetentionPeriod.Seconds())
+	out.Codecs = info.SupportedCodecs
+
+	for _, p := range info.Partitions {
+		partition := Partition{
+			ID:             p.ID,
+			Active:         p.Active,
+			StartOffset:    p.StartOffset,
+			EndOffset:      p.EndOffset,
+			StoreSizeBytes: p.StoreSizeBytes,
+		}
+
+		if !p.LastWriteTime.IsZero() {
+			partition.LastWriteTime = p.LastWriteTime.Format(time.RFC3339)
+		}
+
+		out.Partitions = append(out.Partitions, partition)
+	}
+
+	for _, c := range info.Consumers {
+		consumer := Consumer{Name: c.Name, Important: c.Important, Lag: c.Lag}
+		for _, p := range c.Partitions {
+			consumer.Partitions = append(consumer.Partitions, ConsumerPartition(p))
+		}
+
+		out.Consumers = append(out.Consumers, consumer)
+	}
+
+	return nil
+}
+
+type ConsumerRequest struct {
+	Pipeline string `json:"pipeline"`
+	// Topic defaults to the pipeline topic
+	Topic    string `json:"topic"`
+	Consumer string `json:"consumer"`
+	// Codecs supported by the added consumer, all codecs when empty
+	Codecs []string `json:"codecs"`
+}
+
+type ConsumerResponse struct{}
+
+// AddConsumer registers the consumer on the topic.
+func (r *rpc) AddConsumer(in *ConsumerRequest, _ *ConsumerResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	return d.AddConsumer(ctx, in.Topic, in.Consumer, in.Codecs)
+}
+
+// DropConsumer removes the consumer and its committed offsets from the topic.
+func (r *rpc) DropConsumer(in *ConsumerRequest, _ *ConsumerResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	return d.DropConsumer(ctx, in.Topic, in.Consumer)
+}
+
+type SetPartitionsRequest struct {
+	Pipeline string `json:"pipeline"`
+	// Topic defaults to the pipeline topic
+	Topic      string `json:"topic"`
+	Partitions int64  `json:"partitions"`
+}
+
+type SetPartitionsResponse struct{}
+
+// SetPartitions increases the number of partitions of the topic.
+func (r *rpc) SetPartitions(in *SetPartitionsRequest, _ *SetPartitionsResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	return d.SetPartitions(ctx, in.Topic, in.Partitions)
+}
+
+type StatsRequest struct {
+	Pipeline string `json:"pipeline"`
+}
+
+type StatsResponse struct {
+	InFlight   int64            `json:"in_flight"`
+	Delayed    int64            `json:"delayed"`
+	Lag        int64            `json:"lag"`
+	Partitions []TopicPartition `json:"partitions"`
+	// Error is set when the lag could not be described
+	Error string `json:"error"`
+}
+
+type TopicPartition struct {
+	Topic     string `json:"topic"`
+	Partition int64  `json:"partition"`
+}
+
+// Stats returns the in-flight and delayed jobs, the consumer lag and the partitions assigned to this instance.
+func (r *rpc) Stats(in *StatsRequest, out *StatsResponse) error {
+	d, err := r.plugin.driver(in.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+
+	stats, err := d.Stats(ctx)
+	if err != nil {
+		out.Error = err.Error()
+	}
+
+	out.InFlight = stats.InFlight
+	out.Delayed = stats.Delayed
+	out.Lag = stats.Lag
+
+	for _, partition := range stats.Partitions {
+		out.Partitions = append(out.Partitions, TopicPartition(partition))
+	}
+
+	return nil
+}
+
+// messages converts the RPC jobs, the request is rejected when a job has no name.
+func (r *rpc) messages(d *ydbjobs.Driver, pipeline string, in []*Job) ([]jobs.Message, error) {
+	priority := (*d.Pipeline.Load()).Priority()
+
+	msgs := make([]jobs.Message, len(in))
+	for i, job := range in {
+		if job.Job == "" {
+			return nil, fmt.Errorf("job %d (id %q) has no name", i, job.ID)
+		}
+
+		// like the jobs plugin, a job without ID gets a generated one
+		if job.ID == "" {
+			job.ID = uuid.NewString()
+		}
+
+		// like the jobs plugin, a job without priority inherits the pipeline one
+		if job.Priority == 0 {
+			job.Priority = priority
+		}
+
+		msgs[i] = &message{job: job, pipeline: pipeline}
+	}
+
+	return msgs, nil
+}
+
+// normalizeParams converts integral JSON numbers to int64, JSON decodes all numbers as float64.
+func normalizeParams(params map[string]any) map[string]any {
+	for name, value := range params {
+		if f, ok := value.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			params[name] = int64(f)
+		}
+	}
+
+	return params
+}
+
+// message adapts the RPC job to the jobs message.
+type message struct {
+	job      *Job
+	pipeline string
+}
+
+func (m *message) ID() string {
+	return m.job.ID
+}
+
+func (m *message) GroupID() string {
+	return m.pipeline
+}
+
+func (m *message) Priority() int64 {
+	return m.job.Priority
+}
+
+func (m *message) Name() string {
+	return m.job.Job
+}
+
+func (m *message) Payload() []byte {
+	return []byte(m.job.Payload)
+}
+
+func (m *message) Delay() int64 {
+	return m.job.Delay
+}
+
+func (m *message) AutoAck() bool {
+	return m.job.AutoAck
+}
+
+func (m *message) UpdatePriority(priority int64) {
+	m.job.Priority = priority
+}
+
+func (m *message) Headers() map[string][]string {
+	return m.job.Headers
+}
+
+func (m *message) Offset() int64 {
+	return 0
+}
+
+func (m *message) Partition() int32 {
+	return 0
+}
+
+func (m *message) Topic() string {
+	return ""
+}
+
+func (m *message) Metadata() string {
+	return ""
+}
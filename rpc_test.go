@@ -0,0 +1,40 @@
+package ydb
+
+import (
+	"github.com/retailcrm/roadrunner-ydb/ydbjobs"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type testPipeline struct {
+	jobs.Pipeline
+}
+
+func (p testPipeline) Priority() int64 { return 10 }
+
+func TestRPCMessages(t *testing.T) {
+	d := &ydbjobs.Driver{}
+
+	var pipe jobs.Pipeline = testPipeline{}
+	d.Pipeline.Store(&pipe)
+
+	r := &rpc{}
+
+	msgs, err := r.messages(d, "test", []*Job{
+		{Job: "first", ID: "id"},
+		{Job: "second", Priority: 5},
+	})
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	assert.Equal(t, "id", msgs[0].ID())
+	assert.Equal(t, int64(10), msgs[0].Priority())
+
+	assert.NotEmpty(t, msgs[1].ID(), "a job without ID gets a generated one")
+	assert.Equal(t, int64(5), msgs[1].Priority())
+
+	_, err = r.messages(d, "test", []*Job{{Job: "first"}, {ID: "id"}})
+	assert.ErrorContains(t, err, "has no name")
+}
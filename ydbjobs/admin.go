@@ -0,0 +1,207 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"go.uber.org/zap"
+	"time"
+)
+
+type TopicInfo struct {
+	Path            string
+	Partitions      []PartitionInfo
+	RetentionPeriod time.Duration
+	SupportedCodecs []string
+	Consumers       []ConsumerInfo
+}
+
+type PartitionInfo struct {
+	ID     int64
+	Active bool
+	// StartOffset and EndOffset are the offsets of the first stored message and of the next written one
+	StartOffset    int64
+	EndOffset      int64
+	StoreSizeBytes int64
+	LastWriteTime  time.Time
+}
+
+type ConsumerInfo struct {
+	Name       string
+	Important  bool
+	Partitions []ConsumerPartitionInfo
+	// Lag is the number of uncommitted messages in all partitions
+	Lag int64
+}
+
+type ConsumerPartitionInfo struct {
+	ID              int64
+	CommittedOffset int64
+	LastReadOffset  int64
+	Lag             int64
+	ReaderName      string
+}
+
+// DescribeTopic returns the partitions, settings and consumers of the topic with committed offsets and lag
+// of every consumer. An empty path means the pipeline topic.
+func (d *Driver) DescribeTopic(ctx context.Context, path string) (*TopicInfo, error) {
+	path = d.topicPath(path)
+
+	description, err := d.Client.Describe(ctx, path, topicoptions.IncludePartitionStats())
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TopicInfo{
+		Path:            path,
+		Partitions:      make([]PartitionInfo, len(description.Partitions)),
+		RetentionPeriod: description.RetentionPeriod,
+		SupportedCodecs: make([]string, len(description.SupportedCodecs)),
+		Consumers:       make([]ConsumerInfo, len(description.Consumers)),
+	}
+
+	for i, p := range description.Partitions {
+		info.Partitions[i] = PartitionInfo{
+			ID:             p.PartitionID,
+			Active:         p.Active,
+			StartOffset:    p.PartitionStats.PartitionsOffset.Start,
+			EndOffset:      p.PartitionStats.PartitionsOffset.End,
+			StoreSizeBytes: p.PartitionStats.StoreSizeBytes,
+		}
+
+		if p.PartitionStats.LastWriteTime != nil {
+			info.Partitions[i].LastWriteTime = *p.PartitionStats.LastWriteTime
+		}
+	}
+
+	for i, codec := range description.SupportedCodecs {
+		info.SupportedCodecs[i] = codecName(codec)
+	}
+
+	for i, c := range description.Consumers {
+		consumer, err := d.describeConsumer(ctx, path, c.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		consumer.Important = c.Important
+		info.Consumers[i] = *consumer
+	}
+
+	return info, nil
+}
+
+func (d *Driver) describeConsumer(ctx context.Context, path string, name string) (*ConsumerInfo, error) {
+	description, err := d.Client.DescribeTopicConsumer(ctx, path, name, topicoptions.IncludeConsumerStats())
+	if err != nil {
+		return nil, errors.Errorf("failed to describe consumer %s: %v", name, err)
+	}
+
+	info := &ConsumerInfo{
+		Name:       name,
+		Partitions: make([]ConsumerPartitionInfo, len(description.Partitions)),
+	}
+
+	for i, p := range description.Partitions {
+		stats := p.PartitionConsumerStats
+		lag := max(p.PartitionStats.PartitionsOffset.End-stats.CommittedOffset, 0)
+
+		info.Partitions[i] = ConsumerPartitionInfo{
+			ID:              p.PartitionID,
+			CommittedOffset: stats.CommittedOffset,
+			LastReadOffset:  stats.LastReadOffset,
+			Lag:             lag,
+			ReaderName:      stats.ReaderName,
+		}
+		info.Lag += lag
+	}
+
+	return info, nil
+}
+
+// AddConsumer registers the consumer on the topic, all codecs are supported when none are given.
+func (d *Driver) AddConsumer(ctx context.Context, path string, name string, codecs []string) error {
+	path = d.topicPath(path)
+
+	consumer := topictypes.Consumer{
+		Name:            name,
+		SupportedCodecs: make([]topictypes.Codec, len(codecs)),
+	}
+
+	for i, codec := range codecs {
+		c, err := lookupCodec(codec)
+		if err != nil {
+			return err
+		}
+
+		consumer.SupportedCodecs[i] = c.id
+	}
+
+	err := d.Client.Alter(ctx, path, topicoptions.AlterWithAddConsumers(consumer))
+	if err != nil {
+		return err
+	}
+
+	d.Logger.Info("consumer registered", zap.String("topic", path), zap.String("consumer", name))
+
+	return nil
+}
+
+// DropConsumer removes the consumer and its committed offsets from the topic.
+// The consumer of the pipeline can't be removed while the pipeline exists.
+func (d *Driver) DropConsumer(ctx context.Context, path string, name string) error {
+	path = d.topicPath(path)
+
+	if d.Cfg.ConsumerOpts != nil && d.Cfg.ConsumerOpts.Name == name {
+		return errors.Errorf("consumer %s is used by the pipeline", name)
+	}
+
+	err := d.Client.Alter(ctx, path, topicoptions.AlterWithDropConsumers(name))
+	if err != nil {
+		return err
+	}
+
+	d.Logger.Info("consumer removed", zap.String("topic", path), zap.String("consumer", name))
+
+	return nil
+}
+
+// SetPartitions increases the number of active partitions of the topic, partitions can't be removed.
+func (d *Driver) SetPartitions(ctx context.Context, path string, partitions int64) error {
+	path = d.topicPath(path)
+
+	description, err := d.Client.Describe(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	// partitions split or merged by autopartitioning stay in the description as inactive
+	var current int64
+	for _, partition := range description.Partitions {
+		if partition.Active {
+			current++
+		}
+	}
+
+	if partitions < current {
+		return errors.Errorf("topic %s has %d active partitions, the number of partitions can't be decreased", path, current)
+	}
+
+	err = d.Client.Alter(ctx, path, topicoptions.AlterWithMinActivePartitions(partitions))
+	if err != nil {
+		return err
+	}
+
+	d.Logger.Info("topic partitions changed", zap.String("topic", path), zap.Int64("partitions", partitions))
+
+	return nil
+}
+
+func (d *Driver) topicPath(path string) string {
+	if path == "" {
+		return d.Cfg.Topic
+	}
+
+	return path
+}
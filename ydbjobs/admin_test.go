@@ -0,0 +1,33 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestSetPartitionsActive(t *testing.T) {
+	client := &declareClient{
+		topics: map[string]*topictypes.TopicDescription{
+			"jobs": {
+				Path: "jobs",
+				Partitions: []topictypes.PartitionInfo{
+					{PartitionID: 0, Active: false, ChildPartitionIDs: []int64{1, 2}},
+					{PartitionID: 1, Active: true, ParentPartitionIDs: []int64{0}},
+					{PartitionID: 2, Active: true, ParentPartitionIDs: []int64{0}},
+				},
+			},
+		},
+	}
+
+	d := &Driver{Cfg: Config{Topic: "jobs"}, Client: client, Logger: zap.NewNop()}
+
+	assert.ErrorContains(t, d.SetPartitions(context.Background(), "", 1), "topic jobs has 2 active partitions")
+	assert.Empty(t, client.alters)
+
+	require.NoError(t, d.SetPartitions(context.Background(), "", 2), "the inactive partition is not counted")
+	assert.Equal(t, []string{"jobs"}, client.alters)
+}
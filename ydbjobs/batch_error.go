@@ -0,0 +1,37 @@
+package ydbjobs
+
+import (
+	"fmt"
+)
+
+// BatchError lists the jobs of a batch that were not pushed, the rest of the batch is written.
+type BatchError struct {
+	// Failed is ordered by the position of the jobs in the batch
+	Failed []FailedJob
+}
+
+type FailedJob struct {
+	// Index is the position of the job in the batch
+	Index int
+	ID    string
+	Err   error
+}
+
+func newBatchError(items []*Item, errs []error) error {
+	var failed []FailedJob
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, FailedJob{Index: i, ID: items[i].ID(), Err: err})
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return &BatchError{Failed: failed}
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("failed to push %d jobs of the batch, first error: %v", len(e.Failed), e.Failed[0].Err)
+}
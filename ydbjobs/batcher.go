@@ -0,0 +1,148 @@
+package ydbjobs
+
+import (
+	"context"
+	"errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"time"
+)
+
+var errProducerStopped = errors.New("producer is stopped")
+
+type batchRequest struct {
+	message topicwriter.Message
+	size    int
+	done    chan batchResult
+}
+
+type batchResult struct {
+	seqNo int64
+	err   error
+}
+
+// batcher collects messages pushed concurrently and puts them into the writer in a single call
+// once the batch is full or the flush interval elapses since the first message of the batch.
+type batcher struct {
+	send     func(ctx context.Context, messages []topicwriter.Message) (int64, error)
+	size     int
+	bytes    int
+	interval time.Duration
+	timeout  time.Duration
+
+	requests chan *batchRequest
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newBatcher(
+	send func(ctx context.Context, messages []topicwriter.Message) (int64, error),
+	size int,
+	bytes int,
+	interval time.Duration,
+	timeout time.Duration,
+) *batcher {
+	b := &batcher{
+		send:     send,
+		size:     size,
+		bytes:    bytes,
+		interval: interval,
+		timeout:  timeout,
+		requests: make(chan *batchRequest),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+
+	go b.loop()
+
+	return b
+}
+
+// Add puts the message into the current batch, waits until the batch is written and returns the sequence
+// number of the message. The message may still be written when the context is canceled after the message
+// was added to the batch.
+func (b *batcher) Add(ctx context.Context, message topicwriter.Message, size int) (int64, error) {
+	req := &batchRequest{
+		message: message,
+		size:    size,
+		done:    make(chan batchResult, 1),
+	}
+
+	select {
+	case b.requests <- req:
+	case <-b.stopCh:
+		return 0, errProducerStopped
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case res := <-req.done:
+		return res.seqNo, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Stop writes the pending batch and rejects new messages.
+func (b *batcher) Stop() {
+	close(b.stopCh)
+	<-b.doneCh
+}
+
+func (b *batcher) loop() {
+	defer close(b.doneCh)
+
+	timer := time.NewTimer(b.interval)
+	timer.Stop()
+
+	var (
+		pending []*batchRequest
+		bytes   int
+	)
+
+	flush := func() {
+		timer.Stop()
+
+		if len(pending) == 0 {
+			return
+		}
+
+		messages := make([]topicwriter.Message, len(pending))
+		for i, req := range pending {
+			messages[i] = req.message
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		seqNo, err := b.send(ctx, messages)
+		cancel()
+
+		for i, req := range pending {
+			req.done <- batchResult{seqNo: seqNo + int64(i), err: err}
+		}
+
+		pending = nil
+		bytes = 0
+	}
+
+	for {
+		select {
+		case req := <-b.requests:
+			if len(pending) == 0 {
+				timer.Reset(b.interval)
+			}
+
+			pending = append(pending, req)
+			bytes += req.size
+
+			if len(pending) >= b.size || (b.bytes > 0 && bytes >= b.bytes) {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-b.stopCh:
+			flush()
+
+			return
+		}
+	}
+}
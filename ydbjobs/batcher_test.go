@@ -0,0 +1,127 @@
+package ydbjobs
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSender records the batches written by the batcher and numbers their messages from one.
+type testSender struct {
+	mu      sync.Mutex
+	batches [][]topicwriter.Message
+	seqNo   int64
+	err     error
+}
+
+func (s *testSender) send(_ context.Context, messages []topicwriter.Message) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches = append(s.batches, messages)
+	first := s.seqNo + 1
+	s.seqNo += int64(len(messages))
+
+	return first, s.err
+}
+
+func (s *testSender) sizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes := make([]int, len(s.batches))
+	for i, batch := range s.batches {
+		sizes[i] = len(batch)
+	}
+
+	return sizes
+}
+
+type addResult struct {
+	seqNo int64
+	err   error
+}
+
+// addAll adds the messages concurrently and returns the result of each one.
+func addAll(b *batcher, sizes ...int) []addResult {
+	results := make([]addResult, len(sizes))
+
+	var wg sync.WaitGroup
+	for i, size := range sizes {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			message := topicwriter.Message{Data: bytes.NewReader(make([]byte, size))}
+			results[i].seqNo, results[i].err = b.Add(context.Background(), message, size)
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func TestBatcherSize(t *testing.T) {
+	sender := &testSender{}
+	b := newBatcher(sender.send, 3, 0, time.Hour, time.Second)
+	defer b.Stop()
+
+	results := addAll(b, 1, 1, 1)
+
+	assert.Equal(t, []int{3}, sender.sizes())
+
+	seqNos := make([]int64, 0, len(results))
+	for _, res := range results {
+		require.NoError(t, res.err)
+		seqNos = append(seqNos, res.seqNo)
+	}
+
+	assert.ElementsMatch(t, []int64{1, 2, 3}, seqNos, "every push gets the seqno of its message")
+}
+
+func TestBatcherBytes(t *testing.T) {
+	sender := &testSender{}
+	b := newBatcher(sender.send, 100, 10, time.Hour, time.Second)
+	defer b.Stop()
+
+	for _, res := range addAll(b, 6, 6) {
+		require.NoError(t, res.err)
+	}
+
+	assert.Equal(t, []int{2}, sender.sizes())
+}
+
+func TestBatcherFlushInterval(t *testing.T) {
+	sender := &testSender{}
+	b := newBatcher(sender.send, 100, 0, 20*time.Millisecond, time.Second)
+	defer b.Stop()
+
+	start := time.Now()
+	res := addAll(b, 1)[0]
+
+	require.NoError(t, res.err)
+	assert.Equal(t, int64(1), res.seqNo)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, []int{1}, sender.sizes())
+}
+
+func TestBatcherError(t *testing.T) {
+	sender := &testSender{err: assert.AnError}
+	b := newBatcher(sender.send, 2, 0, time.Hour, time.Second)
+
+	for _, res := range addAll(b, 1, 1) {
+		assert.ErrorIs(t, res.err, assert.AnError, "every push of the failed batch gets the error")
+	}
+
+	b.Stop()
+
+	_, err := b.Add(context.Background(), topicwriter.Message{}, 1)
+	assert.ErrorIs(t, err, errProducerStopped)
+}
@@ -0,0 +1,125 @@
+package ydbjobs
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	CodecRaw  = "raw"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+	CodecLzop = "lzop"
+)
+
+// codec binds a topic codec to its encoder and decoder, nil functions mean the SDK implementation.
+type codec struct {
+	id      topictypes.Codec
+	encoder topicoptions.CreateEncoderFunc
+	decoder topicoptions.CreateDecoderFunc
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]codec{
+		CodecRaw:  {id: topictypes.CodecRaw},
+		CodecGzip: {id: topictypes.CodecGzip},
+		CodecZstd: {id: topictypes.CodecZstd, encoder: zstdEncoder, decoder: zstdDecoder},
+	}
+)
+
+// RegisterCodec makes the codec available to producer_options.codec and declare.codecs by name and adds its decoder
+// to all readers. It is meant for lzop, which has no implementation in the SDK, and for custom codecs with ids
+// from topictypes.CodecCustomerFirst to topictypes.CodecCustomerEnd. It must be called before pipelines start.
+func RegisterCodec(
+	name string,
+	id topictypes.Codec,
+	encoder topicoptions.CreateEncoderFunc,
+	decoder topicoptions.CreateDecoderFunc,
+) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[name] = codec{id: id, encoder: encoder, decoder: decoder}
+}
+
+func lookupCodec(name string) (codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[name]
+	if !ok {
+		if name == CodecLzop {
+			return codec{}, errors.Str("lzop has no built-in implementation, register it with ydbjobs.RegisterCodec")
+		}
+
+		return codec{}, errors.Errorf("unknown codec %q", name)
+	}
+
+	return c, nil
+}
+
+// codecName returns the registered name of the codec or its number when the codec is not registered.
+func codecName(id topictypes.Codec) string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	for name, c := range codecs {
+		if c.id == id {
+			return name
+		}
+	}
+
+	return strconv.Itoa(int(id))
+}
+
+func writerCodecOptions(name string) ([]topicoptions.WriterOption, error) {
+	c, err := lookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []topicoptions.WriterOption{
+		topicoptions.WithWriterCodec(c.id),
+	}
+
+	if c.encoder != nil {
+		options = append(options, topicoptions.WithWriterAddEncoder(c.id, c.encoder))
+	}
+
+	return options, nil
+}
+
+// readerCodecOptions adds decoders of all registered codecs, messages may be written by producers with other codecs.
+func readerCodecOptions() []topicoptions.ReaderOption {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	var options []topicoptions.ReaderOption
+	for _, c := range codecs {
+		if c.decoder != nil {
+			options = append(options, topicoptions.WithAddDecoder(c.id, c.decoder))
+		}
+	}
+
+	return options
+}
+
+func zstdEncoder(w io.Writer) (io.WriteCloser, error) {
+	// the encoder implements Reset, so the SDK reuses it between messages
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func zstdDecoder(r io.Reader) (io.Reader, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
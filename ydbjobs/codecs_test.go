@@ -0,0 +1,64 @@
+package ydbjobs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"io"
+	"maps"
+	"strconv"
+	"testing"
+)
+
+// restoreCodecs brings back the registered codecs after the test.
+func restoreCodecs(t *testing.T) {
+	t.Helper()
+
+	codecsMu.RLock()
+	saved := maps.Clone(codecs)
+	codecsMu.RUnlock()
+
+	t.Cleanup(func() {
+		codecsMu.Lock()
+		codecs = saved
+		codecsMu.Unlock()
+	})
+}
+
+func TestRegisterCodec(t *testing.T) {
+	restoreCodecs(t)
+
+	_, err := writerCodecOptions(CodecLzop)
+	assert.ErrorContains(t, err, "register it with ydbjobs.RegisterCodec")
+
+	_, err = writerCodecOptions("snappy")
+	assert.ErrorContains(t, err, `unknown codec "snappy"`)
+
+	readers := len(readerCodecOptions())
+
+	encoder := func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+	decoder := func(r io.Reader) (io.Reader, error) { return r, nil }
+
+	RegisterCodec(CodecLzop, topictypes.CodecLzop, encoder, decoder)
+
+	options, err := writerCodecOptions(CodecLzop)
+	require.NoError(t, err)
+	assert.Len(t, options, 2, "the codec and its encoder")
+	assert.Len(t, readerCodecOptions(), readers+1)
+	assert.Equal(t, CodecLzop, codecName(topictypes.CodecLzop))
+
+	// registering the name again replaces the codec
+	RegisterCodec(CodecLzop, topictypes.CodecCustomerFirst, nil, nil)
+
+	c, err := lookupCodec(CodecLzop)
+	require.NoError(t, err)
+	assert.Equal(t, topictypes.CodecCustomerFirst, c.id)
+	assert.Len(t, readerCodecOptions(), readers)
+	assert.Equal(t, strconv.Itoa(int(topictypes.CodecLzop)), codecName(topictypes.CodecLzop), "a codec without a name is reported by its number")
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
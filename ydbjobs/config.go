@@ -1,14 +1,149 @@
 package ydbjobs
 
+import (
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"slices"
+	"time"
+)
+
+const (
+	defaultMaxDelayHold = time.Minute
+
+	defaultIAMEndpoint      = "https://iam.api.cloud.yandex.net/iam/v1/tokens"
+	defaultMetadataEndpoint = "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
+
+	defaultReconnectInitialBackoff = time.Second
+	defaultReconnectMaxBackoff     = 30 * time.Second
+
+	defaultDialTimeout       = 5 * time.Second
+	defaultConnectionTTL     = 30 * time.Second
+	defaultOpenTimeout       = 10 * time.Second
+	defaultReaderInitTimeout = 5 * time.Second
+	defaultWriterInitTimeout = 5 * time.Second
+
+	BalancerRandom  = "random"
+	BalancerLocalDC = "local_dc"
+
+	defaultPushTimeout   = 5 * time.Second
+	defaultFlushInterval = 10 * time.Millisecond
+
+	// AckNone returns from Push once the message is put into the writer buffer
+	AckNone = "none"
+	// AckServer returns from Push once the server acknowledged the message
+	AckServer = "server"
+	// AckFlush returns from Push once the server acknowledged all buffered messages
+	AckFlush = "flush"
+
+	// ConsumeCommit commits offsets of acknowledged messages in the background
+	ConsumeCommit = "commit"
+	// ConsumeTx reads messages in a transaction that commits their offsets together with the attached statements
+	ConsumeTx = "tx"
+
+	defaultTxBatchSize = 1
+	defaultTxTimeout   = time.Minute
+
+	// OrderingPartition delivers the messages of each partition in order
+	OrderingPartition = "partition"
+	// OrderingMessageGroup delivers the messages of each message group in order
+	OrderingMessageGroup = "message_group"
+	// OrderingProducer delivers the messages of each producer in order
+	OrderingProducer = "producer_id"
+
+	defaultMaxInFlightPerKey  = 1
+	defaultOrderedMaxInFlight = 1000
+)
+
 type Config struct {
 	Endpoint          string             `mapstructure:"endpoint"`
 	StaticCredentials *StaticCredentials `mapstructure:"static_credentials"`
+	Auth              *Auth              `mapstructure:"auth"`
 	TLS               *TLS               `mapstructure:"tls"`
+	Connection        *Connection        `mapstructure:"connection"`
 
-	Priority     int           `mapstructure:"priority"`
-	Topic        string        `mapstructure:"topic"`
+	Priority int    `mapstructure:"priority"`
+	Topic    string `mapstructure:"topic"`
+	// Producer set to false makes the pipeline read-only, the producer options then apply to the dead-letter writer
+	Producer     *bool         `mapstructure:"producer"`
 	ProducerOpts *ProducerOpts `mapstructure:"producer_options"`
 	ConsumerOpts *ConsumerOpts `mapstructure:"consumer_options"`
+	Declare      *Declare      `mapstructure:"declare"`
+}
+
+func (c *Config) InitDefaults() {
+	if c.Connection == nil {
+		c.Connection = &Connection{}
+	}
+
+	c.Connection.initDefaults()
+
+	if c.Auth != nil {
+		c.Auth.initDefaults()
+	}
+
+	if c.ProducerOpts == nil {
+		c.ProducerOpts = &ProducerOpts{}
+	}
+
+	c.ProducerOpts.initDefaults()
+
+	if c.ConsumerOpts != nil {
+		c.ConsumerOpts.initDefaults()
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Auth != nil {
+		if c.StaticCredentials != nil {
+			return errors.Str("static_credentials and auth can't be used together")
+		}
+
+		if err := c.Auth.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Connection != nil {
+		if err := c.Connection.validate(); err != nil {
+			return err
+		}
+	}
+
+	if !c.HasProducer() && c.ConsumerOpts == nil {
+		return errors.Str("the pipeline with producer disabled must have consumer_options")
+	}
+
+	if c.ProducerOpts != nil {
+		if err := c.ProducerOpts.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.ConsumerOpts != nil {
+		if err := c.ConsumerOpts.validate(); err != nil {
+			return err
+		}
+
+		// requeued and postponed jobs are written to the pipeline topic, they would be lost if it is not read
+		if c.HasProducer() && !c.ConsumerOpts.reads(c.Topic) {
+			return errors.Errorf("consumer_options.topics must include the pipeline topic %q, "+
+				"requeued and delayed jobs are written to it", c.Topic)
+		}
+	}
+
+	if c.Declare != nil {
+		if err := c.Declare.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HasProducer reports whether jobs can be pushed to the pipeline.
+func (c *Config) HasProducer() bool {
+	return c.Producer == nil || *c.Producer
 }
 
 type StaticCredentials struct {
@@ -16,14 +151,505 @@ type StaticCredentials struct {
 	Password string `mapstructure:"password"`
 }
 
+// Auth configures token based authentication, exactly one method must be set.
+type Auth struct {
+	AccessToken string `mapstructure:"access_token"`
+	// AccessTokenFile is re-read when the file is modified
+	AccessTokenFile       string  `mapstructure:"access_token_file"`
+	OAuth2                *OAuth2 `mapstructure:"oauth2"`
+	ServiceAccountKeyFile string  `mapstructure:"service_account_key_file"`
+	Metadata              bool    `mapstructure:"metadata"`
+	// IAMEndpoint exchanges JWTs signed with the service account key for IAM tokens
+	IAMEndpoint string `mapstructure:"iam_endpoint"`
+	// MetadataEndpoint returns the token of the service account attached to the VM
+	MetadataEndpoint string `mapstructure:"metadata_endpoint"`
+}
+
+// OAuth2 configures OAuth 2.0 token exchange (RFC 8693) either inline or from the SDK config file.
+type OAuth2 struct {
+	ConfigFile       string   `mapstructure:"config_file"`
+	TokenEndpoint    string   `mapstructure:"token_endpoint"`
+	Audience         []string `mapstructure:"audience"`
+	Scope            []string `mapstructure:"scope"`
+	Resource         []string `mapstructure:"resource"`
+	SubjectToken     string   `mapstructure:"subject_token"`
+	SubjectTokenType string   `mapstructure:"subject_token_type"`
+}
+
+func (a *Auth) initDefaults() {
+	if a.IAMEndpoint == "" {
+		a.IAMEndpoint = defaultIAMEndpoint
+	}
+
+	if a.MetadataEndpoint == "" {
+		a.MetadataEndpoint = defaultMetadataEndpoint
+	}
+}
+
+func (a *Auth) validate() error {
+	methods := 0
+	for _, set := range []bool{
+		a.AccessToken != "",
+		a.AccessTokenFile != "",
+		a.OAuth2 != nil,
+		a.ServiceAccountKeyFile != "",
+		a.Metadata,
+	} {
+		if set {
+			methods++
+		}
+	}
+
+	if methods != 1 {
+		return errors.Str("auth: exactly one of access_token, access_token_file, oauth2, service_account_key_file, metadata must be set")
+	}
+
+	if a.OAuth2 != nil && a.OAuth2.ConfigFile == "" && a.OAuth2.TokenEndpoint == "" {
+		return errors.Str("auth.oauth2: either config_file or token_endpoint must be set")
+	}
+
+	return nil
+}
+
 type TLS struct {
 	Ca string `mapstructure:"ca"`
 }
 
+// Connection configures the YDB driver connection and the topic streams initialization.
+type Connection struct {
+	DialTimeout   time.Duration `mapstructure:"dial_timeout"`
+	ConnectionTTL time.Duration `mapstructure:"connection_ttl"`
+	// OpenTimeout limits the initial driver connection including endpoints discovery
+	OpenTimeout       time.Duration `mapstructure:"open_timeout"`
+	ReaderInitTimeout time.Duration `mapstructure:"reader_init_timeout"`
+	WriterInitTimeout time.Duration `mapstructure:"writer_init_timeout"`
+	// Balancer is either random or local_dc, the SDK default is used when empty
+	Balancer string `mapstructure:"balancer"`
+	// AutoRetry enables retries of failed operations inside the SDK
+	AutoRetry bool `mapstructure:"auto_retry"`
+	// RetryBudget limits retries to the percent of operations, zero means no limit
+	RetryBudget int        `mapstructure:"retry_budget"`
+	Keepalive   *Keepalive `mapstructure:"keepalive"`
+}
+
+// Keepalive configures gRPC keepalive pings.
+type Keepalive struct {
+	Time                time.Duration `mapstructure:"time"`
+	Timeout             time.Duration `mapstructure:"timeout"`
+	PermitWithoutStream bool          `mapstructure:"permit_without_stream"`
+}
+
+func (c *Connection) initDefaults() {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+
+	if c.ConnectionTTL == 0 {
+		c.ConnectionTTL = defaultConnectionTTL
+	}
+
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = defaultOpenTimeout
+	}
+
+	if c.ReaderInitTimeout == 0 {
+		c.ReaderInitTimeout = defaultReaderInitTimeout
+	}
+
+	if c.WriterInitTimeout == 0 {
+		c.WriterInitTimeout = defaultWriterInitTimeout
+	}
+}
+
+func (c *Connection) validate() error {
+	// the options are checked in a fixed order, so the same one is reported on every run
+	for _, option := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"dial_timeout", c.DialTimeout},
+		{"connection_ttl", c.ConnectionTTL},
+		{"open_timeout", c.OpenTimeout},
+		{"reader_init_timeout", c.ReaderInitTimeout},
+		{"writer_init_timeout", c.WriterInitTimeout},
+	} {
+		if option.value < 0 {
+			return errors.Errorf("connection.%s must not be negative, got %s", option.name, option.value)
+		}
+	}
+
+	switch c.Balancer {
+	case "", BalancerRandom, BalancerLocalDC:
+	default:
+		return errors.Errorf("connection.balancer must be one of %s, %s, got %q", BalancerRandom, BalancerLocalDC, c.Balancer)
+	}
+
+	if c.RetryBudget < 0 || c.RetryBudget > 100 {
+		return errors.Errorf("connection.retry_budget must be a percent between 0 and 100, got %d", c.RetryBudget)
+	}
+
+	if c.RetryBudget > 0 && !c.AutoRetry {
+		return errors.Str("connection.retry_budget requires connection.auto_retry")
+	}
+
+	if c.Keepalive != nil {
+		if c.Keepalive.Time <= 0 {
+			return errors.Errorf("connection.keepalive.time must be positive, got %s", c.Keepalive.Time)
+		}
+
+		if c.Keepalive.Timeout < 0 {
+			return errors.Errorf("connection.keepalive.timeout must not be negative, got %s", c.Keepalive.Timeout)
+		}
+	}
+
+	return nil
+}
+
 type ProducerOpts struct {
+	// Id defaults to the host name followed by the pipeline name, see defaultProducerID
 	Id string `mapstructure:"id"`
+	// Ack is one of none, server or flush
+	Ack         string        `mapstructure:"ack"`
+	PushTimeout time.Duration `mapstructure:"push_timeout"`
+	// Codec is raw, gzip, zstd or a codec registered with RegisterCodec
+	Codec string `mapstructure:"codec"`
+	// BufferSize is the number of messages the writer keeps until they are acknowledged by the server
+	BufferSize int `mapstructure:"buffer_size"`
+	// BatchSize enables batching of concurrent pushes, a batch is written once it has BatchSize messages,
+	// BatchBytes of payload or FlushInterval elapses since its first message
+	BatchSize     int           `mapstructure:"batch_size"`
+	BatchBytes    int           `mapstructure:"batch_bytes"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+func (p *ProducerOpts) initDefaults() {
+	if p.Ack == "" {
+		p.Ack = AckServer
+	}
+
+	if p.PushTimeout == 0 {
+		p.PushTimeout = defaultPushTimeout
+	}
+
+	if p.Codec == "" {
+		p.Codec = CodecGzip
+	}
+
+	if p.FlushInterval == 0 {
+		p.FlushInterval = defaultFlushInterval
+	}
+}
+
+func (p *ProducerOpts) validate() error {
+	switch p.Ack {
+	case AckNone, AckServer, AckFlush:
+	default:
+		return errors.Errorf("producer_options.ack must be one of %s, %s, %s, got %q", AckNone, AckServer, AckFlush, p.Ack)
+	}
+
+	if p.PushTimeout < 0 {
+		return errors.Errorf("producer_options.push_timeout must not be negative, got %s", p.PushTimeout)
+	}
+
+	if _, err := lookupCodec(p.Codec); err != nil {
+		return errors.Errorf("producer_options.codec: %v", err)
+	}
+
+	if p.BufferSize < 0 || p.BatchSize < 0 || p.BatchBytes < 0 {
+		return errors.Str("producer_options: buffer_size, batch_size and batch_bytes must not be negative")
+	}
+
+	if p.FlushInterval < 0 {
+		return errors.Errorf("producer_options.flush_interval must not be negative, got %s", p.FlushInterval)
+	}
+
+	return nil
 }
 
 type ConsumerOpts struct {
 	Name string `mapstructure:"name"`
+	// RawMessages disables decoding of the RoadRunner envelope, every message is treated
+	// as written by a third-party producer
+	RawMessages bool            `mapstructure:"raw_messages"`
+	DeadLetter  *DeadLetterOpts `mapstructure:"dead_letter"`
+	// MaxDelayHold limits how long a delayed job is held by the consumer before it is written back to the topic
+	MaxDelayHold time.Duration  `mapstructure:"max_delay_hold"`
+	Reconnect    *ReconnectOpts `mapstructure:"reconnect"`
+	// Mode is commit or tx
+	Mode string `mapstructure:"mode"`
+	// TxBatchSize is the max number of messages read in one transaction in the tx mode
+	TxBatchSize int `mapstructure:"tx_batch_size"`
+	// TxTimeout limits how long a transaction waits for acknowledgements of its messages before the rollback
+	TxTimeout time.Duration `mapstructure:"tx_timeout"`
+	// Topics are read instead of the pipeline topic, jobs are still pushed and requeued to the pipeline topic
+	Topics []*TopicSelector `mapstructure:"topics"`
+	// MaxInFlight limits jobs delivered to the queue and not acknowledged yet, reading stops when it is reached
+	MaxInFlight int `mapstructure:"max_in_flight"`
+	// BatchSize is the max number of messages read at once
+	BatchSize int `mapstructure:"batch_size"`
+	// BufferBytes is the size of the reader buffer, it limits the bytes of messages read ahead from the server
+	BufferBytes int `mapstructure:"buffer_bytes"`
+	// Ordering is partition, message_group or producer_id, jobs of the same key are delivered in the read order
+	// with at most MaxInFlightPerKey of them not acknowledged at a time. Jobs are not ordered when empty.
+	Ordering          string `mapstructure:"ordering"`
+	MaxInFlightPerKey int    `mapstructure:"max_in_flight_per_key"`
+}
+
+// TopicSelector selects a topic to read, optionally only some of its partitions and messages.
+type TopicSelector struct {
+	Path string `mapstructure:"path"`
+	// Partitions limits reading to the partitions, all partitions are read when empty
+	Partitions []int64 `mapstructure:"partitions"`
+	// ReadFrom is an RFC 3339 timestamp, messages written before it are skipped
+	ReadFrom string `mapstructure:"read_from"`
+	// MaxTimeLag skips messages written earlier than this duration ago
+	MaxTimeLag time.Duration `mapstructure:"max_time_lag"`
+}
+
+func (c *ConsumerOpts) initDefaults() {
+	if c.MaxDelayHold <= 0 {
+		c.MaxDelayHold = defaultMaxDelayHold
+	}
+
+	if c.Reconnect == nil {
+		c.Reconnect = &ReconnectOpts{}
+	}
+
+	c.Reconnect.initDefaults()
+
+	if c.Mode == "" {
+		c.Mode = ConsumeCommit
+	}
+
+	if c.TxBatchSize == 0 {
+		c.TxBatchSize = defaultTxBatchSize
+	}
+
+	if c.TxTimeout == 0 {
+		c.TxTimeout = defaultTxTimeout
+	}
+
+	if c.MaxInFlightPerKey == 0 {
+		c.MaxInFlightPerKey = defaultMaxInFlightPerKey
+	}
+
+	// without the limit an ordered consumer would read the whole backlog behind a slow key into memory
+	if c.Ordering != "" && c.Mode != ConsumeTx && c.MaxInFlight == 0 {
+		c.MaxInFlight = defaultOrderedMaxInFlight
+	}
+}
+
+func (c *ConsumerOpts) validate() error {
+	switch c.Mode {
+	case ConsumeCommit, ConsumeTx:
+	default:
+		return errors.Errorf("consumer_options.mode must be one of %s, %s, got %q", ConsumeCommit, ConsumeTx, c.Mode)
+	}
+
+	if c.TxBatchSize < 0 {
+		return errors.Errorf("consumer_options.tx_batch_size must not be negative, got %d", c.TxBatchSize)
+	}
+
+	if c.TxTimeout < 0 {
+		return errors.Errorf("consumer_options.tx_timeout must not be negative, got %s", c.TxTimeout)
+	}
+
+	if c.MaxInFlight < 0 || c.BatchSize < 0 || c.BufferBytes < 0 {
+		return errors.Str("consumer_options: max_in_flight, batch_size and buffer_bytes must not be negative")
+	}
+
+	// a transaction holds at most tx_batch_size jobs and the next one is read after it completes
+	if c.Mode == ConsumeTx && (c.MaxInFlight > 0 || c.BatchSize > 0) {
+		return errors.Errorf("consumer_options: max_in_flight and batch_size are not supported in the %s mode, "+
+			"use tx_batch_size", ConsumeTx)
+	}
+
+	switch c.Ordering {
+	case "", OrderingPartition, OrderingMessageGroup, OrderingProducer:
+	default:
+		return errors.Errorf("consumer_options.ordering must be one of %s, %s, %s, got %q",
+			OrderingPartition, OrderingMessageGroup, OrderingProducer, c.Ordering)
+	}
+
+	if c.Ordering != "" && c.Mode == ConsumeTx {
+		return errors.Errorf("consumer_options.ordering is not supported in the %s mode", ConsumeTx)
+	}
+
+	if c.MaxInFlightPerKey < 0 {
+		return errors.Errorf("consumer_options.max_in_flight_per_key must not be negative, got %d", c.MaxInFlightPerKey)
+	}
+
+	for i, t := range c.Topics {
+		if err := t.validate(); err != nil {
+			return errors.Errorf("consumer_options.topics[%d]: %v", i, err)
+		}
+	}
+
+	if c.DeadLetter != nil {
+		if err := c.DeadLetter.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Reconnect != nil {
+		return c.Reconnect.validate()
+	}
+
+	return nil
+}
+
+func (t *TopicSelector) validate() error {
+	if t == nil || t.Path == "" {
+		return errors.Str("path is required")
+	}
+
+	if t.ReadFrom != "" {
+		if _, err := time.Parse(time.RFC3339, t.ReadFrom); err != nil {
+			return errors.Errorf("read_from must be an RFC 3339 timestamp: %v", err)
+		}
+	}
+
+	if t.MaxTimeLag < 0 {
+		return errors.Errorf("max_time_lag must not be negative, got %s", t.MaxTimeLag)
+	}
+
+	for _, partition := range t.Partitions {
+		if partition < 0 {
+			return errors.Errorf("partition IDs must not be negative, got %d", partition)
+		}
+	}
+
+	return nil
+}
+
+// reads reports whether the topic is read by the consumer.
+func (c *ConsumerOpts) reads(topic string) bool {
+	if len(c.Topics) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(c.Topics, func(t *TopicSelector) bool {
+		return t.Path == topic
+	})
+}
+
+// readSelectors returns the selectors of the configured topics or of the pipeline topic when none are configured.
+func (c *ConsumerOpts) readSelectors(topic string) topicoptions.ReadSelectors {
+	if len(c.Topics) == 0 {
+		return topicoptions.ReadSelectors{
+			topicoptions.ReadSelector{
+				Path: topic,
+			},
+		}
+	}
+
+	selectors := make(topicoptions.ReadSelectors, len(c.Topics))
+	for i, t := range c.Topics {
+		// the timestamp is checked by validate
+		readFrom, _ := time.Parse(time.RFC3339, t.ReadFrom)
+
+		selectors[i] = topicoptions.ReadSelector{
+			Path:       t.Path,
+			Partitions: t.Partitions,
+			ReadFrom:   readFrom,
+			MaxTimeLag: t.MaxTimeLag,
+		}
+	}
+
+	return selectors
+}
+
+// Declare creates the topics of the pipeline and registers its consumer when they don't exist.
+// Settings of existing topics are not changed.
+type Declare struct {
+	// Partitions is the number of partitions of a created topic, the server default is used when zero
+	Partitions      int64         `mapstructure:"partitions"`
+	RetentionPeriod time.Duration `mapstructure:"retention_period"`
+	// Codecs supported by a created topic and the consumer, all codecs are supported when empty
+	Codecs []string `mapstructure:"codecs"`
+}
+
+func (d *Declare) validate() error {
+	if d.Partitions < 0 {
+		return errors.Errorf("declare.partitions must not be negative, got %d", d.Partitions)
+	}
+
+	if d.RetentionPeriod < 0 {
+		return errors.Errorf("declare.retention_period must not be negative, got %s", d.RetentionPeriod)
+	}
+
+	if _, err := d.codecs(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Declare) codecs() ([]topictypes.Codec, error) {
+	codecs := make([]topictypes.Codec, len(d.Codecs))
+	for i, name := range d.Codecs {
+		c, err := lookupCodec(name)
+		if err != nil {
+			return nil, errors.Errorf("declare.codecs: %v", err)
+		}
+
+		codecs[i] = c.id
+	}
+
+	return codecs, nil
+}
+
+// ReconnectOpts configures restarts of the reader after it fails.
+type ReconnectOpts struct {
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	// MaxAttempts is the number of consecutive failed restarts after which the consumer gives up,
+	// zero means that the reader is restarted until the pipeline is stopped
+	MaxAttempts int `mapstructure:"max_attempts"`
+}
+
+func (r *ReconnectOpts) initDefaults() {
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = defaultReconnectInitialBackoff
+	}
+
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = defaultReconnectMaxBackoff
+	}
+}
+
+func (r *ReconnectOpts) validate() error {
+	if r.InitialBackoff < 0 || r.MaxBackoff < 0 {
+		return errors.Str("consumer_options.reconnect: backoff must not be negative")
+	}
+
+	if r.MaxBackoff < r.InitialBackoff {
+		return errors.Errorf("consumer_options.reconnect.max_backoff (%s) must not be less than initial_backoff (%s)",
+			r.MaxBackoff, r.InitialBackoff)
+	}
+
+	if r.MaxAttempts < 0 {
+		return errors.Errorf("consumer_options.reconnect.max_attempts must not be negative, got %d", r.MaxAttempts)
+	}
+
+	return nil
+}
+
+type DeadLetterOpts struct {
+	Topic string `mapstructure:"topic"`
+	// MaxAttempts is the number of requeues after which the job is moved to the dead-letter topic,
+	// zero means that only negatively acknowledged jobs are moved
+	MaxAttempts int `mapstructure:"max_attempts"`
+}
+
+func (d *DeadLetterOpts) validate() error {
+	if d.Topic == "" {
+		return errors.Str("consumer_options.dead_letter.topic is required")
+	}
+
+	if d.MaxAttempts < 0 {
+		return errors.Errorf("consumer_options.dead_letter.max_attempts must not be negative, got %d", d.MaxAttempts)
+	}
+
+	return nil
 }
@@ -0,0 +1,60 @@
+package ydbjobs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// validConfig returns the config of a pipeline reading its own topic.
+func validConfig() *Config {
+	cfg := &Config{
+		Endpoint:     "grpc://localhost:2136/local",
+		Topic:        "orders",
+		ConsumerOpts: &ConsumerOpts{Name: "consumer"},
+	}
+	cfg.InitDefaults()
+
+	return cfg
+}
+
+func TestConfigValidateTopics(t *testing.T) {
+	cfg := validConfig()
+	require.NoError(t, cfg.Validate())
+
+	cfg.ConsumerOpts.Topics = []*TopicSelector{{Path: "orders-retry"}}
+	assert.ErrorContains(t, cfg.Validate(), "must include the pipeline topic")
+
+	cfg.ConsumerOpts.Topics = append(cfg.ConsumerOpts.Topics, &TopicSelector{Path: "orders"})
+	assert.NoError(t, cfg.Validate())
+
+	// jobs are not written back by a consumer-only pipeline
+	producer := false
+	cfg.Producer = &producer
+	cfg.ConsumerOpts.Topics = []*TopicSelector{{Path: "orders-retry"}}
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestConfigValidateDeadLetter(t *testing.T) {
+	cfg := validConfig()
+
+	cfg.ConsumerOpts.DeadLetter = &DeadLetterOpts{}
+	assert.ErrorContains(t, cfg.Validate(), "dead_letter.topic is required")
+
+	cfg.ConsumerOpts.DeadLetter = &DeadLetterOpts{Topic: "orders-dead-letter", MaxAttempts: -1}
+	assert.ErrorContains(t, cfg.Validate(), "dead_letter.max_attempts must not be negative")
+
+	cfg.ConsumerOpts.DeadLetter.MaxAttempts = 3
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestConfigValidateConnectionOrder(t *testing.T) {
+	cfg := validConfig()
+	cfg.Connection.ConnectionTTL = -1
+	cfg.Connection.ReaderInitTimeout = -1
+	cfg.Connection.WriterInitTimeout = -1
+
+	for range 10 {
+		assert.ErrorContains(t, cfg.Validate(), "connection.connection_ttl must not be negative")
+	}
+}
@@ -3,18 +3,59 @@ package ydbjobs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Consumer interface {
 	Start() <-chan *topicreader.Message
+	Ack(msg *topicreader.Message) error
+	// Err returns the last reader error while the reader is being restarted or after the consumer gave up
+	Err() error
+	// Failed reports that the consumer gave up restarting the reader
+	Failed() bool
+	// InFlight returns the number of delivered messages that are not acknowledged yet
+	InFlight() int
+	// Partitions returns the partitions assigned to the reader
+	Partitions() []TopicPartition
 	Stop()
 }
 
+type consumerHealth struct {
+	err    error
+	failed bool
+}
+
 type consumer struct {
-	reader *topicreader.Reader
-	logger *zap.Logger
+	// mu guards the reader, which is replaced when it fails
+	mu        sync.Mutex
+	reader    *topicreader.Reader
+	connect   func(ctx context.Context) (*topicreader.Reader, error)
+	reconnect *ReconnectOpts
+	failures  int
+	health    atomic.Pointer[consumerHealth]
+
+	logger   *zap.Logger
+	metrics  *pipelineMetrics
+	tracer   trace.TracerProvider
+	tracker  *offsetTracker
+	assigned *assignedPartitions
+	stopped  uint32
+
+	// maxInFlight stops reading while that many messages are not acknowledged, acked wakes the reading up
+	maxInFlight int
+	batchSize   int
+	acked       chan struct{}
+	// ordering holds back the messages of the keys with too many jobs in flight, nil when jobs are not ordered
+	ordering *orderingGate
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -23,29 +64,60 @@ type consumer struct {
 
 func NewConsumer(
 	reader *topicreader.Reader,
+	connect func(ctx context.Context) (*topicreader.Reader, error),
+	opts *ConsumerOpts,
+	assigned *assignedPartitions,
 	logger *zap.Logger,
+	metrics *pipelineMetrics,
+	tracer trace.TracerProvider,
 ) Consumer {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &consumer{
-		reader: reader,
-		logger: logger,
-		ctx:    ctx,
-		cancel: cancel,
-		doneCh: make(chan struct{}),
+	c := &consumer{
+		reader:      reader,
+		connect:     connect,
+		reconnect:   opts.Reconnect,
+		logger:      logger,
+		metrics:     metrics,
+		tracer:      tracer,
+		tracker:     newOffsetTracker(),
+		assigned:    assigned,
+		maxInFlight: opts.MaxInFlight,
+		batchSize:   opts.BatchSize,
+		acked:       make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		doneCh:      make(chan struct{}),
 	}
+
+	if opts.Ordering != "" {
+		c.ordering = newOrderingGate(opts.Ordering, opts.MaxInFlightPerKey)
+	}
+
+	c.health.Store(&consumerHealth{})
+
+	return c
 }
+
 func (c *consumer) Start() <-chan *topicreader.Message {
 	output := make(chan *topicreader.Message)
+	commitDone := make(chan struct{})
+	dispatchDone := make(chan struct{})
 
 	c.logger.Debug("consumer started")
 
+	go c.commitLoop(commitDone)
+
+	if c.ordering != nil {
+		go c.dispatch(output, dispatchDone)
+	} else {
+		close(dispatchDone)
+	}
+
 	go func() {
 		defer close(c.doneCh)
 		defer close(output)
 
-		var commitMessage *topicreader.Message
-
 		for {
 			select {
 			case <-c.ctx.Done():
@@ -53,7 +125,17 @@ func (c *consumer) Start() <-chan *topicreader.Message {
 			default:
 			}
 
-			batch, err := c.reader.ReadMessagesBatch(c.ctx)
+			count, ok := c.window()
+			if !ok {
+				goto shutdown
+			}
+
+			var options []topicreader.ReadBatchOption
+			if count > 0 {
+				options = append(options, topicreader.WithBatchMaxCount(count))
+			}
+
+			batch, err := c.currentReader().ReadMessagesBatch(c.ctx, options...)
 
 			if err != nil {
 				if errors.Is(err, context.Canceled) {
@@ -62,40 +144,125 @@ func (c *consumer) Start() <-chan *topicreader.Message {
 
 				c.logger.Error("failed to read messages", zap.Error(err))
 
-				goto shutdown
+				if !c.restart(err) {
+					goto shutdown
+				}
+
+				continue
 			}
 
+			c.failures = 0
+			c.metrics.read.Add(float64(len(batch.Messages)))
+
 			for _, message := range batch.Messages {
+				c.tracker.Track(message)
+				c.metrics.inFlight.Set(float64(c.tracker.InFlight()))
+
+				// the message waits for its key in the gate, so the other partitions keep being read and delivered
+				if c.ordering != nil {
+					c.ordering.Add(message)
+
+					continue
+				}
+
 				select {
 				case output <- message:
-					commitMessage = message
 				case <-c.ctx.Done():
 					goto shutdown
 				}
 			}
+		}
 
-			if err := c.reader.Commit(context.Background(), batch); err != nil {
-				c.logger.Error("failed to commit offsets", zap.Error(err))
-			}
+	shutdown:
+		atomic.StoreUint32(&c.stopped, 1)
+		c.cancel()
+		<-commitDone
+		<-dispatchDone
 
-			commitMessage = nil
+		// commit everything that was acknowledged before the shutdown,
+		// the rest will be redelivered to the next reader
+		c.commit()
+		c.closeReader()
+
+		c.metrics.inFlight.Set(0)
+	}()
+
+	return output
+}
+
+// Ack marks the message as processed, its offset is committed as soon as
+// all preceding messages of the same partition are acknowledged too.
+func (c *consumer) Ack(msg *topicreader.Message) error {
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return errors.New("failed to acknowledge the message, the consumer is stopped, it will be redelivered")
+	}
+
+	// the key is released even when the offset can't be committed, the message is not in flight anymore
+	if c.ordering != nil {
+		c.ordering.Done(msg)
+	}
+
+	if !c.tracker.Ack(msg) {
+		return fmt.Errorf("failed to acknowledge the message, partition %d of topic %s was reassigned, it will be redelivered",
+			msg.PartitionID(), msg.Topic())
+	}
+
+	c.metrics.inFlight.Set(float64(c.tracker.InFlight()))
+
+	select {
+	case c.acked <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// window waits until fewer than max_in_flight read messages are not acknowledged and returns the max number
+// of messages to read, zero means no limit. Messages waiting for their ordering keys count towards the limit,
+// so they are bounded in memory. It returns false when the consumer is stopped.
+func (c *consumer) window() (int, bool) {
+	for {
+		if c.maxInFlight == 0 {
+			return c.batchSize, true
 		}
 
-	shutdown:
-		if commitMessage != nil {
-			if err := c.reader.Commit(context.Background(), commitMessage); err != nil {
-				c.logger.Error("failed to commit offsets during shutdown", zap.Error(err))
+		inFlight := c.tracker.InFlight()
+		if free := c.maxInFlight - inFlight; free > 0 {
+			if c.batchSize > 0 {
+				free = min(free, c.batchSize)
 			}
+
+			return free, true
 		}
 
-		err := c.reader.Close(context.Background())
+		c.logger.Debug("in-flight limit reached, reading paused", zap.Int("in_flight", inFlight))
 
-		if err != nil {
-			c.logger.Error("failed to close reader", zap.Error(err))
+		select {
+		case <-c.acked:
+		case <-c.ctx.Done():
+			return 0, false
 		}
-	}()
+	}
+}
 
-	return output
+func (c *consumer) Err() error {
+	return c.health.Load().err
+}
+
+func (c *consumer) Failed() bool {
+	return c.health.Load().failed
+}
+
+func (c *consumer) InFlight() int {
+	if c.ordering != nil {
+		return c.tracker.InFlight() - c.ordering.Pending()
+	}
+
+	return c.tracker.InFlight()
+}
+
+func (c *consumer) Partitions() []TopicPartition {
+	return c.assigned.List()
 }
 
 func (c *consumer) Stop() {
@@ -107,3 +274,173 @@ func (c *consumer) Stop() {
 
 	c.logger.Debug("consumer stopped successfully")
 }
+
+// dispatch hands out the messages released by the ordering gate.
+func (c *consumer) dispatch(output chan<- *topicreader.Message, done chan struct{}) {
+	defer close(done)
+
+	for {
+		message, ok := c.ordering.Next(c.ctx)
+		if !ok {
+			return
+		}
+
+		select {
+		case output <- message:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *consumer) commitLoop(done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.tracker.Notify():
+			c.commit()
+		}
+	}
+}
+
+func (c *consumer) currentReader() *topicreader.Reader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reader
+}
+
+func (c *consumer) closeReader() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reader == nil {
+		return
+	}
+
+	err := c.reader.Close(context.Background())
+	if err != nil {
+		c.logger.Error("failed to close reader", zap.Error(err))
+	}
+
+	c.reader = nil
+	c.assigned.Reset()
+}
+
+// restart replaces the failed reader, retrying with exponential backoff. The messages read by the failed reader
+// can't be committed anymore and are redelivered. It returns false when the consumer is stopped or gives up.
+func (c *consumer) restart(cause error) bool {
+	c.health.Store(&consumerHealth{err: cause})
+
+	c.closeReader()
+	c.tracker.Reset()
+	if c.ordering != nil {
+		c.ordering.Reset()
+	}
+	c.metrics.inFlight.Set(0)
+
+	for {
+		c.failures++
+
+		if c.reconnect.MaxAttempts > 0 && c.failures > c.reconnect.MaxAttempts {
+			err := fmt.Errorf("consumer gave up after %d failed reader restarts: %w", c.reconnect.MaxAttempts, cause)
+			c.health.Store(&consumerHealth{err: err, failed: true})
+			c.logger.Error("consumer stopped", zap.Error(err))
+
+			return false
+		}
+
+		backoff := c.backoff()
+		c.logger.Warn("restarting reader",
+			zap.Int("attempt", c.failures),
+			zap.Duration("backoff", backoff),
+			zap.Error(cause),
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return false
+		}
+
+		reader, err := c.connect(c.ctx)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return false
+			}
+
+			cause = err
+			c.health.Store(&consumerHealth{err: cause})
+
+			continue
+		}
+
+		c.mu.Lock()
+		c.reader = reader
+		c.mu.Unlock()
+
+		c.health.Store(&consumerHealth{})
+		c.logger.Info("reader restarted", zap.Int("attempt", c.failures))
+
+		return true
+	}
+}
+
+// backoff doubles the initial backoff with every consecutive failure up to the max backoff
+// and randomizes it within [d/2, d] to spread restarts of several consumers.
+func (c *consumer) backoff() time.Duration {
+	d := c.reconnect.InitialBackoff
+	for i := 1; i < c.failures && d < c.reconnect.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	d = min(d, c.reconnect.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// commit hands the committable messages to the reader, which sends them to the server in the background,
+// so a pass doesn't wait for a round-trip per message. The pending commits are sent when the reader is closed.
+func (c *consumer) commit() {
+	// the lock is not held while committing, so the reading is not blocked by the commits,
+	// commits to a reader closed meanwhile fail and the messages are redelivered
+	reader := c.currentReader()
+	if reader == nil {
+		return
+	}
+
+	for _, message := range c.tracker.Committable() {
+		ctx := propagator.Extract(context.Background(), metadataCarrier(message.Metadata))
+		ctx, span := c.tracer.Tracer(tracerName).Start(ctx, "ydb_commit",
+			spanAttributes(message.Topic(),
+				attribute.Int64("messaging.ydb.partition", message.PartitionID()),
+				attribute.Int64("messaging.ydb.offset", message.Offset),
+			),
+		)
+
+		if err := reader.Commit(ctx, message); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+
+			c.metrics.commitErrors.Inc()
+			c.logger.Error("failed to commit offsets",
+				zap.Error(err),
+				zap.String("topic", message.Topic()),
+				zap.Int64("partition", message.PartitionID()),
+				zap.Int64("offset", message.Offset),
+			)
+
+			continue
+		}
+
+		span.End()
+		c.metrics.commitLag.Set(time.Since(message.WrittenAt).Seconds())
+	}
+}
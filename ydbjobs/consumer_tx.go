@@ -0,0 +1,368 @@
+package ydbjobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type txStatement struct {
+	id      string
+	query   string
+	options []query.ExecuteOption
+}
+
+// txWrite is a job written to the topic within the transaction, e.g. a requeued or delayed copy of a read job.
+type txWrite struct {
+	topic   string
+	message topicwriter.Message
+}
+
+type txMessage struct {
+	message *topicreader.Message
+	id      string
+	acked   bool
+}
+
+// txBatch is the set of messages read in one transaction, the transaction commits once all of them are acknowledged.
+type txBatch struct {
+	messages   []*txMessage
+	remaining  int
+	statements []txStatement
+	writes     []txWrite
+	done       chan struct{}
+}
+
+// txConsumer reads messages within transactions, the offsets are committed together with the statements
+// attached to the jobs, so a job result stored in a table and the job offset are committed atomically.
+// Only one transaction is processed at a time, messages of a rolled back transaction are redelivered.
+type txConsumer struct {
+	*consumer
+
+	query query.Client
+	// write writes the messages to the topic within the transaction
+	write     func(ctx context.Context, tx query.TxActor, topic string, messages []topicwriter.Message) error
+	batchSize int
+	timeout   time.Duration
+	raw       bool
+
+	// batchMu guards the batch of the current transaction
+	batchMu sync.Mutex
+	batch   *txBatch
+}
+
+func NewTxConsumer(
+	reader *topicreader.Reader,
+	connect func(ctx context.Context) (*topicreader.Reader, error),
+	queryClient query.Client,
+	write func(ctx context.Context, tx query.TxActor, topic string, messages []topicwriter.Message) error,
+	opts *ConsumerOpts,
+	assigned *assignedPartitions,
+	logger *zap.Logger,
+	metrics *pipelineMetrics,
+	tracer trace.TracerProvider,
+) Consumer {
+	return &txConsumer{
+		consumer:  NewConsumer(reader, connect, opts, assigned, logger, metrics, tracer).(*consumer),
+		query:     queryClient,
+		write:     write,
+		batchSize: opts.TxBatchSize,
+		timeout:   opts.TxTimeout,
+		raw:       opts.RawMessages,
+	}
+}
+
+func (c *txConsumer) Start() <-chan *topicreader.Message {
+	output := make(chan *topicreader.Message)
+
+	c.logger.Debug("transactional consumer started")
+
+	go func() {
+		defer close(c.doneCh)
+		defer close(output)
+
+		for c.ctx.Err() == nil {
+			var (
+				delivered bool
+				txErr     error
+			)
+
+			err := c.query.Do(c.ctx, func(ctx context.Context, s query.Session) error {
+				delivered, txErr = c.process(ctx, s, output)
+				// the messages of a failed transaction are redelivered by the reader,
+				// so the transaction is not retried once the messages are handed out
+				if delivered {
+					return nil
+				}
+
+				return txErr
+			})
+
+			if err == nil {
+				err = txErr
+			}
+
+			switch {
+			case err == nil:
+			case c.ctx.Err() != nil:
+			case delivered:
+				c.metrics.commitErrors.Inc()
+				c.logger.Error("transaction rolled back, the messages will be redelivered", zap.Error(err))
+			default:
+				c.logger.Error("failed to read messages", zap.Error(err))
+
+				if !c.restart(err) {
+					goto shutdown
+				}
+			}
+		}
+
+	shutdown:
+		atomic.StoreUint32(&c.stopped, 1)
+		c.cancel()
+		c.closeReader()
+
+		c.metrics.inFlight.Set(0)
+	}()
+
+	return output
+}
+
+// process reads a batch in a new transaction, hands the messages out and commits the transaction with the attached
+// statements once all the messages are acknowledged. It reports whether the messages were handed out.
+func (c *txConsumer) process(ctx context.Context, s query.Session, output chan<- *topicreader.Message) (bool, error) {
+	tx, err := s.Begin(ctx, query.TxSettings(query.WithSerializableReadWrite()))
+	if err != nil {
+		return false, err
+	}
+
+	batch, err := c.currentReader().PopMessagesBatchTx(ctx, tx, topicreader.WithBatchMaxCount(c.batchSize))
+	if err != nil {
+		_ = tx.Rollback(context.Background())
+
+		return false, err
+	}
+
+	c.failures = 0
+	c.metrics.read.Add(float64(len(batch.Messages)))
+
+	b := c.begin(batch.Messages)
+	defer c.end()
+
+	rollback := func(err error) (bool, error) {
+		if rbErr := tx.Rollback(context.Background()); rbErr != nil {
+			c.logger.Error("failed to roll back the transaction", zap.String("tx_id", tx.ID()), zap.Error(rbErr))
+		}
+
+		return true, err
+	}
+
+	for _, message := range batch.Messages {
+		select {
+		case output <- message:
+		case <-ctx.Done():
+			return rollback(ctx.Err())
+		}
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-b.done:
+	case <-timer.C:
+		return rollback(fmt.Errorf("transaction %s timed out waiting for acknowledgements of %d messages",
+			tx.ID(), c.remaining()))
+	case <-ctx.Done():
+		return rollback(ctx.Err())
+	}
+
+	spanCtx := propagator.Extract(context.Background(), metadataCarrier(batch.Messages[0].Metadata))
+	_, span := c.tracer.Tracer(tracerName).Start(spanCtx, "ydb_commit_tx",
+		spanAttributes(batch.Topic(),
+			attribute.Int64("messaging.ydb.partition", batch.PartitionID()),
+			attribute.Int("messaging.batch.message_count", len(batch.Messages)),
+			attribute.String("db.ydb.tx_id", tx.ID()),
+		),
+	)
+	defer span.End()
+
+	if err := c.apply(ctx, tx, b); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return rollback(err)
+	}
+
+	if err := tx.CommitTx(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return true, fmt.Errorf("failed to commit transaction %s: %w", tx.ID(), err)
+	}
+
+	c.metrics.commitLag.Set(time.Since(batch.Messages[len(batch.Messages)-1].WrittenAt).Seconds())
+	c.logger.Debug("transaction committed",
+		zap.String("tx_id", tx.ID()),
+		zap.Int("messages", len(batch.Messages)),
+		zap.Int("statements", len(b.statements)),
+	)
+
+	return true, nil
+}
+
+// apply executes the statements and writes the jobs attached to the batch, they are committed with the offsets.
+func (c *txConsumer) apply(ctx context.Context, tx query.TxActor, b *txBatch) error {
+	for _, statement := range b.statements {
+		if err := tx.Exec(ctx, statement.query, statement.options...); err != nil {
+			return fmt.Errorf("failed to execute the statement attached to job %s: %w", statement.id, err)
+		}
+	}
+
+	// the jobs are grouped by topic keeping the order they were attached in
+	var topics []string
+	messages := make(map[string][]topicwriter.Message)
+	for _, w := range b.writes {
+		if _, ok := messages[w.topic]; !ok {
+			topics = append(topics, w.topic)
+		}
+
+		messages[w.topic] = append(messages[w.topic], w.message)
+	}
+
+	for _, topic := range topics {
+		if err := c.write(ctx, tx, topic, messages[topic]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *txConsumer) begin(messages []*topicreader.Message) *txBatch {
+	b := &txBatch{
+		messages:  make([]*txMessage, len(messages)),
+		remaining: len(messages),
+		done:      make(chan struct{}),
+	}
+
+	for i, message := range messages {
+		b.messages[i] = &txMessage{message: message, id: messageID(message, c.raw)}
+	}
+
+	c.batchMu.Lock()
+	c.batch = b
+	c.batchMu.Unlock()
+
+	c.metrics.inFlight.Set(float64(len(messages)))
+
+	return b
+}
+
+func (c *txConsumer) end() {
+	c.batchMu.Lock()
+	c.batch = nil
+	c.batchMu.Unlock()
+
+	c.metrics.inFlight.Set(0)
+}
+
+func (c *txConsumer) InFlight() int {
+	return c.remaining()
+}
+
+func (c *txConsumer) remaining() int {
+	c.batchMu.Lock()
+	defer c.batchMu.Unlock()
+
+	if c.batch == nil {
+		return 0
+	}
+
+	return c.batch.remaining
+}
+
+// Ack marks the message as processed, the transaction commits once all messages of the batch are acknowledged.
+func (c *txConsumer) Ack(msg *topicreader.Message) error {
+	if atomic.LoadUint32(&c.stopped) == 1 {
+		return errors.New("failed to acknowledge the message, the consumer is stopped, it will be redelivered")
+	}
+
+	c.batchMu.Lock()
+	defer c.batchMu.Unlock()
+
+	if c.batch != nil {
+		for _, m := range c.batch.messages {
+			if m.message != msg {
+				continue
+			}
+
+			if !m.acked {
+				m.acked = true
+				c.batch.remaining--
+				c.metrics.inFlight.Set(float64(c.batch.remaining))
+
+				if c.batch.remaining == 0 {
+					close(c.batch.done)
+				}
+			}
+
+			return nil
+		}
+	}
+
+	return errors.New("failed to acknowledge the message, its transaction was rolled back, it will be redelivered")
+}
+
+// Attach adds the statement to the transaction of the job, it is executed right before the commit.
+// Statements must be attached before the job is acknowledged.
+func (c *txConsumer) Attach(id string, yql string, options ...query.ExecuteOption) error {
+	c.batchMu.Lock()
+	defer c.batchMu.Unlock()
+
+	if c.batch != nil {
+		for _, m := range c.batch.messages {
+			if m.id != id || m.acked {
+				continue
+			}
+
+			c.batch.statements = append(c.batch.statements, txStatement{id: id, query: yql, options: options})
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("job %s is not awaiting acknowledgement in the current transaction", id)
+}
+
+// Write adds the job to the transaction of the read message, it is written to the topic right before the commit,
+// so it is discarded together with the offset if the transaction is rolled back. The job must be attached before
+// the message is acknowledged.
+func (c *txConsumer) Write(msg *topicreader.Message, topic string, message topicwriter.Message) error {
+	c.batchMu.Lock()
+	defer c.batchMu.Unlock()
+
+	if c.batch != nil {
+		for _, m := range c.batch.messages {
+			if m.message != msg || m.acked {
+				continue
+			}
+
+			c.batch.writes = append(c.batch.writes, txWrite{topic: topic, message: message})
+
+			return nil
+		}
+	}
+
+	return errors.New("failed to write the job, the transaction of its message was rolled back, it will be redelivered")
+}
@@ -0,0 +1,79 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"testing"
+)
+
+// testTx fails the statements when execErr is set.
+type testTx struct {
+	query.Transaction
+
+	execErr error
+}
+
+func (tx testTx) ID() string { return "tx" }
+
+func (tx testTx) Exec(context.Context, string, ...query.ExecuteOption) error {
+	return tx.execErr
+}
+
+func TestTxConsumerRollbackRequeued(t *testing.T) {
+	d, producer, _ := newTestDriver(t)
+	ctx := context.Background()
+
+	written := map[string]int{}
+	c := &txConsumer{
+		consumer: &consumer{metrics: NewMetrics().pipeline("test")},
+		write: func(_ context.Context, _ query.TxActor, topic string, messages []topicwriter.Message) error {
+			written[topic] += len(messages)
+
+			return nil
+		},
+	}
+
+	newItem := func(msg *topicreader.Message) *Item {
+		return &Item{
+			Job:       "job",
+			Ident:     messageID(msg, false),
+			headers:   map[string][]string{},
+			Options:   &Options{},
+			message:   msg,
+			consumer:  c,
+			requeueFn: d.requeue,
+		}
+	}
+
+	msg := testMessage(0, 1, "")
+	b := c.begin([]*topicreader.Message{msg})
+
+	item := newItem(msg)
+	require.NoError(t, c.Attach(item.ID(), "UPSERT INTO results (id) VALUES (1)"))
+	require.NoError(t, item.Requeue(nil, 0))
+	assert.Zero(t, c.remaining())
+
+	// the statement fails, so the batch is rolled back together with the requeued job
+	assert.ErrorIs(t, c.apply(ctx, testTx{execErr: assert.AnError}, b), assert.AnError)
+	c.end()
+
+	assert.Empty(t, written)
+	assert.Zero(t, producer.written.Load(), "the job is not written outside the transaction")
+
+	// a worker finishing the job of the rolled back batch doesn't write it either
+	assert.Error(t, newItem(msg).Requeue(nil, 0))
+
+	// the message is redelivered and requeued again in the next transaction
+	redelivered := testMessage(0, 1, "")
+	b = c.begin([]*topicreader.Message{redelivered})
+	require.NoError(t, newItem(redelivered).Requeue(nil, 0))
+	require.NoError(t, c.apply(ctx, testTx{}, b))
+	c.end()
+
+	assert.Equal(t, map[string]int{"jobs": 1}, written, "the requeued job is written once")
+	assert.Zero(t, producer.written.Load())
+}
@@ -0,0 +1,118 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"go.uber.org/zap"
+	"slices"
+)
+
+// declare creates the missing topics of the pipeline and registers the consumer on the topics it reads.
+// It is safe to run concurrently from several instances, a topic or a consumer created by another one is kept.
+func (d *Driver) declare(ctx context.Context) error {
+	codecs, err := d.Cfg.Declare.codecs()
+	if err != nil {
+		return err
+	}
+
+	topics := []string{d.Cfg.Topic}
+
+	var reads []string
+	if d.Cfg.ConsumerOpts != nil {
+		reads = selectorPaths(d.Cfg.ConsumerOpts.readSelectors(d.Cfg.Topic))
+		topics = append(topics, reads...)
+
+		if d.Cfg.ConsumerOpts.DeadLetter != nil {
+			topics = append(topics, d.Cfg.ConsumerOpts.DeadLetter.Topic)
+		}
+	}
+
+	declared := make(map[string]bool, len(topics))
+	for _, path := range topics {
+		if declared[path] {
+			continue
+		}
+
+		declared[path] = true
+
+		var consumer *topictypes.Consumer
+		if slices.Contains(reads, path) {
+			consumer = &topictypes.Consumer{
+				Name:            d.Cfg.ConsumerOpts.Name,
+				SupportedCodecs: codecs,
+			}
+		}
+
+		if err := d.declareTopic(ctx, path, codecs, consumer); err != nil {
+			return errors.Errorf("failed to declare topic %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) declareTopic(
+	ctx context.Context,
+	path string,
+	codecs []topictypes.Codec,
+	consumer *topictypes.Consumer,
+) error {
+	description, err := d.Client.Describe(ctx, path)
+
+	switch {
+	case err == nil:
+	case ydb.IsOperationErrorSchemeError(err), ydb.IsOperationErrorNotFoundError(err):
+		options := []topicoptions.CreateOption{
+			topicoptions.CreateWithSupportedCodecs(codecs...),
+		}
+
+		if d.Cfg.Declare.Partitions > 0 {
+			options = append(options, topicoptions.CreateWithMinActivePartitions(d.Cfg.Declare.Partitions))
+		}
+
+		if d.Cfg.Declare.RetentionPeriod > 0 {
+			options = append(options, topicoptions.CreateWithRetentionPeriod(d.Cfg.Declare.RetentionPeriod))
+		}
+
+		if consumer != nil {
+			options = append(options, topicoptions.CreateWithConsumer(*consumer))
+		}
+
+		err = d.Client.Create(ctx, path, options...)
+		if err == nil {
+			d.Logger.Info("topic created", zap.String("topic", path), zap.Int64("partitions", d.Cfg.Declare.Partitions))
+
+			return nil
+		}
+
+		if !ydb.IsOperationErrorAlreadyExistsError(err) {
+			return err
+		}
+
+		// the topic was created concurrently, the consumer may be missing
+		description, err = d.Client.Describe(ctx, path)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if consumer == nil || slices.ContainsFunc(description.Consumers, func(c topictypes.Consumer) bool {
+		return c.Name == consumer.Name
+	}) {
+		return nil
+	}
+
+	err = d.Client.Alter(ctx, path, topicoptions.AlterWithAddConsumers(*consumer))
+	if err != nil && !ydb.IsOperationErrorAlreadyExistsError(err) {
+		return err
+	}
+
+	d.Logger.Info("consumer registered", zap.String("topic", path), zap.String("consumer", consumer.Name))
+
+	return nil
+}
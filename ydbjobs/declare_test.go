@@ -0,0 +1,77 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"go.uber.org/zap"
+	"testing"
+)
+
+// declareClient serves the descriptions of existing topics and records the changes, adding a consumer
+// registers it in the description.
+type declareClient struct {
+	topic.Client
+
+	topics  map[string]*topictypes.TopicDescription
+	creates []string
+	alters  []string
+}
+
+func (c *declareClient) Describe(
+	_ context.Context,
+	path string,
+	_ ...topicoptions.DescribeOption,
+) (topictypes.TopicDescription, error) {
+	description, ok := c.topics[path]
+	if !ok {
+		return topictypes.TopicDescription{}, assert.AnError
+	}
+
+	return *description, nil
+}
+
+func (c *declareClient) Create(context.Context, string, ...topicoptions.CreateOption) error {
+	panic("existing topics must not be created")
+}
+
+func (c *declareClient) Alter(_ context.Context, path string, _ ...topicoptions.AlterOption) error {
+	c.alters = append(c.alters, path)
+	c.topics[path].Consumers = append(c.topics[path].Consumers, topictypes.Consumer{Name: "consumer"})
+
+	return nil
+}
+
+func TestDeclareExistingTopic(t *testing.T) {
+	client := &declareClient{
+		topics: map[string]*topictypes.TopicDescription{
+			"jobs": {Path: "jobs", Consumers: []topictypes.Consumer{{Name: "other"}}},
+			"dlq":  {Path: "dlq"},
+		},
+	}
+
+	d := &Driver{
+		Cfg: Config{
+			Topic: "jobs",
+			ConsumerOpts: &ConsumerOpts{
+				Name:       "consumer",
+				DeadLetter: &DeadLetterOpts{Topic: "dlq"},
+			},
+			Declare: &Declare{},
+		},
+		Client: client,
+		Logger: zap.NewNop(),
+	}
+
+	require.NoError(t, d.declare(context.Background()))
+	assert.Equal(t, []string{"jobs"}, client.alters, "the missing consumer is added to the read topic only")
+
+	require.NoError(t, d.declare(context.Background()))
+	assert.Equal(t, []string{"jobs"}, client.alters, "a registered consumer is kept")
+
+	delete(client.topics, "dlq")
+	assert.ErrorContains(t, d.declare(context.Background()), "failed to declare topic dlq")
+}
@@ -2,13 +2,21 @@ package ydbjobs
 
 import (
 	"context"
+	"fmt"
 	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
 	"github.com/roadrunner-server/errors"
 	"github.com/ydb-platform/ydb-go-sdk/v3"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,19 +24,103 @@ const (
 )
 
 type Driver struct {
-	Cfg      Config
-	Driver   *ydb.Driver
+	Cfg    Config
+	Driver *ydb.Driver
+	// Release releases the shared YDB connection, it is closed when no pipelines use it
+	Release  func(ctx context.Context) error
 	Client   topic.Client
 	Queue    jobs.Queue
 	Pipeline atomic.Pointer[jobs.Pipeline]
 	Logger   *zap.Logger
-	consumer Consumer
-	producer Producer
-	ready    uint32
+	Metrics  *Metrics
+	Tracer   trace.TracerProvider
+
+	// mu guards the lifecycle state and the components replaced on transitions,
+	// pushes hold it for reading, so the producer is not stopped under them
+	mu         sync.RWMutex
+	state      lifecycleState
+	consumer   Consumer
+	producer   Producer
+	deadLetter Producer
+	scheduler  *scheduler
+	metrics    *pipelineMetrics
+	// runErr is the error the pipeline failed to run with
+	runErr error
+	// lag is the consumer lag reported by State and Stats
+	lag lagCache
+	// newConsumer builds the consumer instead of buildConsumer, used by tests
+	newConsumer func(sched *scheduler) (Consumer, error)
 }
 
 func (d *Driver) Push(ctx context.Context, msg jobs.Message) error {
-	return d.producer.Produce(ctx, msg)
+	ctx, span := d.Tracer.Tracer(tracerName).Start(ctx, "ydb_push",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		spanAttributes(d.Cfg.Topic),
+	)
+	defer span.End()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	err := d.checkPush()
+	if err == nil {
+		err = d.producer.Produce(ctx, fromJob(msg))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// PushBatch writes the jobs to the topic in a single call. When some jobs are not pushed,
+// a *BatchError with the error of each failed job is returned.
+func (d *Driver) PushBatch(ctx context.Context, msgs []jobs.Message) error {
+	ctx, span := d.Tracer.Tracer(tracerName).Start(ctx, "ydb_push_batch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		spanAttributes(d.Cfg.Topic, attribute.Int("messaging.batch.message_count", len(msgs))),
+	)
+	defer span.End()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkPush(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return err
+	}
+
+	items := make([]*Item, len(msgs))
+	for i := range msgs {
+		items[i] = fromJob(msgs[i])
+	}
+
+	err := newBatchError(items, d.producer.ProduceBatch(ctx, items))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return err
+	}
+
+	return nil
+}
+
+// checkPush reports whether jobs can be pushed, it must be called with the lifecycle lock held.
+func (d *Driver) checkPush() error {
+	if !d.Cfg.HasProducer() {
+		return errors.Str("failed to push to the pipeline, it is consumer-only (producer: false)")
+	}
+
+	if d.state != stateRunning && d.state != statePaused {
+		return errors.Errorf("failed to push to the pipeline, it is %s", d.state)
+	}
+
+	return nil
 }
 
 func (d *Driver) Run(ctx context.Context, pipeline jobs.Pipeline) error {
@@ -42,70 +134,147 @@ func (d *Driver) Run(ctx context.Context, pipeline jobs.Pipeline) error {
 		return errors.Errorf("no such pipeline registered: %s", pipe.Name())
 	}
 
-	defer atomic.StoreUint32(&d.ready, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
+	if d.state != stateInitialized {
+		return errors.Errorf("failed to run the pipeline, it is %s", d.state)
+	}
+
+	d.metrics = d.Metrics.pipeline(pipe.Name())
+
+	err := d.start(ctx)
+	if err != nil {
+		// the components started before the failure are stopped, the connection is released by Stop
+		_ = d.shutdown(context.Background())
+		d.state = stateFailed
+		d.runErr = err
+
+		return err
+	}
+
+	d.state = stateRunning
+
+	d.Logger.Info("pipeline started - ready for operations",
+		zap.String("pipeline", pipeline.Name()),
+		zap.String("topic", d.Cfg.Topic),
+	)
+
+	return nil
+}
+
+func (d *Driver) start(ctx context.Context) error {
 	var err error
 
-	if d.Cfg.ConsumerOpts != nil {
-		d.consumer, err = BuildConsumer(
+	if d.Cfg.Declare != nil {
+		err = d.declare(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	producerID := d.Cfg.ProducerOpts.Id
+	if producerID == "" {
+		producerID = defaultProducerID((*d.Pipeline.Load()).Name())
+	}
+
+	if d.Cfg.HasProducer() {
+		d.producer, err = BuildProducer(
 			d.Client,
 			d.Logger,
+			d.metrics,
 			d.Cfg.Topic,
-			d.Cfg.ConsumerOpts.Name,
-			func(record *topicreader.Message) error {
-				d.Queue.Insert(fromMessage(record, pipe.Name()))
-
-				return nil
-			},
+			producerID,
+			d.Cfg.ProducerOpts,
+			d.Cfg.Connection.WriterInitTimeout,
 		)
 		if err != nil {
 			return err
 		}
 	}
 
-	d.producer, err = BuildProducer(
-		d.Client,
-		d.Logger,
-		d.Cfg.Topic,
-		d.Cfg.ProducerOpts.Id,
-	)
-	if err != nil {
-		return err
+	if d.Cfg.ConsumerOpts != nil && d.Cfg.ConsumerOpts.DeadLetter != nil {
+		d.deadLetter, err = BuildProducer(
+			d.Client,
+			d.Logger,
+			d.metrics,
+			d.Cfg.ConsumerOpts.DeadLetter.Topic,
+			producerID+"-dead-letter",
+			d.Cfg.ProducerOpts,
+			d.Cfg.Connection.WriterInitTimeout,
+		)
+		if err != nil {
+			return err
+		}
 	}
 
-	d.Logger.Info("pipeline started - ready for operations",
-		zap.String("pipeline", pipeline.Name()),
-		zap.String("topic", d.Cfg.Topic),
-	)
+	if d.Cfg.ConsumerOpts != nil {
+		return d.startConsumer()
+	}
 
 	return nil
 }
 
+// Stop stops the pipeline in any state and releases the connection, it does nothing when the pipeline is stopped.
 func (d *Driver) Stop(ctx context.Context) error {
 	pipe := *d.Pipeline.Load()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state == stateStopped {
+		return nil
+	}
+
 	d.Logger.Info("pipeline shutting down", zap.String("pipeline", pipe.Name()))
+	d.state = stateStopping
 
-	defer atomic.StoreUint32(&d.ready, 0)
+	err := d.shutdown(ctx)
 
-	err := d.producer.Stop(ctx)
-	if err != nil {
-		return err
+	if releaseErr := d.Release(ctx); releaseErr != nil && err == nil {
+		err = releaseErr
 	}
-	d.Logger.Info("producer stopped")
 
+	d.state = stateStopped
+	d.Logger.Info("pipeline stopped", zap.String("pipeline", pipe.Name()))
+
+	return err
+}
+
+// shutdown stops the consumer before the producers, since handling of the consumed jobs writes to them.
+// It stops all components even when some of them fail and returns the first error.
+func (d *Driver) shutdown(ctx context.Context) error {
 	if d.consumer != nil {
-		d.consumer.Stop()
+		d.stopConsumer()
 		d.Logger.Info("consumer stopped")
 	}
 
-	err = d.Driver.Close(ctx)
-	if err != nil {
-		return err
+	var err error
+
+	if d.producer != nil {
+		if stopErr := d.producer.Stop(ctx); stopErr != nil {
+			d.Logger.Error("failed to stop the producer", zap.Error(stopErr))
+			err = stopErr
+		}
+
+		d.producer = nil
+		d.Logger.Info("producer stopped")
 	}
 
-	d.Logger.Info("pipeline stopped", zap.String("pipeline", pipe.Name()))
+	if d.deadLetter != nil {
+		if stopErr := d.deadLetter.Stop(ctx); stopErr != nil {
+			d.Logger.Error("failed to stop the dead-letter producer", zap.Error(stopErr))
 
-	return nil
+			if err == nil {
+				err = stopErr
+			}
+		}
+
+		d.deadLetter = nil
+		d.Logger.Info("dead-letter producer stopped")
+	}
+
+	return err
 }
 
 func (d *Driver) Pause(ctx context.Context, pipeline string) error {
@@ -115,21 +284,33 @@ func (d *Driver) Pause(ctx context.Context, pipeline string) error {
 		return errors.Errorf("no such pipeline: %s", pipe.Name())
 	}
 
-	if atomic.LoadUint32(&d.ready) == 0 {
-		return errors.Errorf("pipeline is not running")
-	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if d.consumer != nil {
-		d.consumer.Stop()
-		d.consumer = nil
+	if err := d.pause(); err != nil {
+		return err
 	}
 
-	atomic.StoreUint32(&d.ready, 0)
 	d.Logger.Info("pipeline paused", zap.String("pipeline", pipeline))
 
 	return nil
 }
 
+func (d *Driver) pause() error {
+	switch d.state {
+	case stateRunning:
+	case statePaused:
+		return errors.Str("pipeline is already paused")
+	default:
+		return errors.Errorf("failed to pause the pipeline, it is %s", d.state)
+	}
+
+	d.stopConsumer()
+	d.state = statePaused
+
+	return nil
+}
+
 func (d *Driver) Resume(ctx context.Context, pipeline string) error {
 	pipe := *d.Pipeline.Load()
 
@@ -137,32 +318,328 @@ func (d *Driver) Resume(ctx context.Context, pipeline string) error {
 		return errors.Errorf("no such pipeline: %s", pipe.Name())
 	}
 
-	if atomic.LoadUint32(&d.ready) == 1 {
-		return errors.Errorf("pipeline is already running")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.resume(); err != nil {
+		return err
+	}
+
+	d.Logger.Info("pipeline resumed", zap.String("pipeline", pipeline))
+
+	return nil
+}
+
+// resume starts a new consumer, the pipeline stays paused when the consumer fails to start.
+func (d *Driver) resume() error {
+	switch d.state {
+	case statePaused:
+	case stateRunning:
+		return errors.Str("pipeline is already running")
+	default:
+		return errors.Errorf("failed to resume the pipeline, it is %s", d.state)
 	}
 
 	if d.Cfg.ConsumerOpts != nil {
-		var err error
+		if err := d.startConsumer(); err != nil {
+			return err
+		}
+	}
+
+	d.state = stateRunning
+
+	return nil
+}
+
+// startConsumer builds the consumer together with the scheduler of its delayed jobs.
+func (d *Driver) startConsumer() error {
+	build := d.buildConsumer
+	if d.newConsumer != nil {
+		build = d.newConsumer
+	}
 
-		d.consumer, err = BuildConsumer(
+	sched := newScheduler()
+
+	consumer, err := build(sched)
+	if err != nil {
+		sched.Stop()
+
+		return err
+	}
+
+	d.consumer = consumer
+	d.scheduler = sched
+
+	return nil
+}
+
+// stopConsumer stops the consumer, the held delayed jobs stay uncommitted and are redelivered.
+func (d *Driver) stopConsumer() {
+	if d.consumer == nil {
+		return
+	}
+
+	d.scheduler.Stop()
+	d.consumer.Stop()
+
+	d.consumer = nil
+	d.scheduler = nil
+}
+
+func (d *Driver) buildConsumer(sched *scheduler) (Consumer, error) {
+	handler := func(record *topicreader.Message, consumer Consumer) error {
+		return d.handleMessage(record, consumer, sched)
+	}
+
+	selectors := d.Cfg.ConsumerOpts.readSelectors(d.Cfg.Topic)
+
+	if d.Cfg.ConsumerOpts.Mode == ConsumeTx {
+		return BuildTxConsumer(
 			d.Client,
+			d.Driver.Query(),
+			d.writeTx,
 			d.Logger,
-			d.Cfg.Topic,
-			d.Cfg.ConsumerOpts.Name,
-			func(record *topicreader.Message) error {
-				d.Queue.Insert(fromMessage(record, pipe.Name()))
-
-				return nil
-			},
+			d.metrics,
+			d.Tracer,
+			selectors,
+			d.Cfg.ConsumerOpts,
+			d.Cfg.Connection.ReaderInitTimeout,
+			handler,
 		)
+	}
 
-		if err != nil {
+	return BuildConsumer(
+		d.Client,
+		d.Logger,
+		d.metrics,
+		d.Tracer,
+		selectors,
+		d.Cfg.ConsumerOpts,
+		d.Cfg.Connection.ReaderInitTimeout,
+		handler,
+	)
+}
+
+func (d *Driver) handleMessage(record *topicreader.Message, consumer Consumer, sched *scheduler) error {
+	pipe := *d.Pipeline.Load()
+
+	ctx := propagator.Extract(context.Background(), metadataCarrier(record.Metadata))
+	ctx, span := d.Tracer.Tracer(tracerName).Start(ctx, "ydb_read",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		spanAttributes(record.Topic(),
+			attribute.Int64("messaging.ydb.partition", record.PartitionID()),
+			attribute.Int64("messaging.ydb.offset", record.Offset),
+		),
+	)
+	defer span.End()
+
+	item := fromMessage(record, consumer, pipe.Name(), d.Cfg.ConsumerOpts.RawMessages)
+	item.requeueFn = d.requeue
+	if d.Cfg.ConsumerOpts.DeadLetter != nil {
+		item.deadLetterFn = d.moveToDeadLetter
+	}
+
+	// replace the raw trace metadata with the read span context, the jobs plugin continues the trace from the headers
+	for _, field := range propagator.Fields() {
+		delete(item.headers, field)
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(item.headers))
+
+	if wait := item.wait(); wait > 0 {
+		// holding the job would keep its transaction open, so it is written back to the topic within it right away
+		if d.Cfg.ConsumerOpts.Mode == ConsumeTx && d.Cfg.HasProducer() {
+			d.postpone(item)
+
+			return nil
+		}
+
+		d.hold(sched, item, wait)
+
+		return nil
+	}
+
+	return d.insert(item)
+}
+
+func (d *Driver) insert(item *Item) error {
+	if item.Options.AutoAck {
+		if err := item.consumer.Ack(item.message); err != nil {
 			return err
 		}
 	}
 
-	atomic.StoreUint32(&d.ready, 1)
-	d.Logger.Info("pipeline resumed", zap.String("pipeline", pipeline))
+	d.Queue.Insert(item)
+
+	return nil
+}
+
+// hold keeps the delayed job in memory until it is due. Since the held message blocks offset commits
+// of its partition, a job due later than max_delay_hold is written back to the topic after the hold.
+func (d *Driver) hold(sched *scheduler, item *Item, wait time.Duration) {
+	sched.Schedule(min(wait, d.Cfg.ConsumerOpts.MaxDelayHold), func() {
+		if item.wait() > 0 {
+			if d.Cfg.HasProducer() {
+				d.postpone(item)
+			} else {
+				d.expire(item)
+			}
+
+			return
+		}
+
+		if err := d.insert(item); err != nil {
+			d.Logger.Error("failed to insert the delayed job", zap.String("id", item.ID()), zap.Error(err))
+		}
+	})
+}
+
+// expire handles a job of a consumer-only pipeline that is still not due after max_delay_hold. The job can't be
+// written back to the pipeline topic, so it is moved to the dead-letter topic when one is configured, otherwise
+// it is delivered early rather than blocking offset commits of its partition.
+func (d *Driver) expire(item *Item) {
+	if d.Cfg.ConsumerOpts.DeadLetter == nil {
+		d.Logger.Warn("delayed job delivered before it is due, the consumer-only pipeline can't write it back",
+			zap.String("id", item.ID()),
+			zap.Duration("wait", item.wait()),
+		)
+
+		if err := d.insert(item); err != nil {
+			d.Logger.Error("failed to insert the delayed job", zap.String("id", item.ID()), zap.Error(err))
+		}
+
+		return
+	}
+
+	reason := fmt.Sprintf("delayed longer than max_delay_hold: %s", d.Cfg.ConsumerOpts.MaxDelayHold)
+
+	// the message stays uncommitted and is redelivered when the job is not written
+	err := d.moveToDeadLetter(context.Background(), item, reason)
+	if err == nil {
+		err = item.consumer.Ack(item.message)
+	}
+
+	if err != nil {
+		d.Logger.Error("failed to move the delayed job to the dead-letter topic", zap.String("id", item.ID()), zap.Error(err))
+	}
+}
+
+func (d *Driver) postpone(item *Item) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	// the message stays uncommitted and is redelivered
+	if d.producer == nil {
+		d.Logger.Error("failed to postpone the delayed job, the pipeline is stopped",
+			zap.String("id", item.ID()),
+			zap.Stringer("state", d.state),
+		)
+
+		return
+	}
+
+	job := item.Copy()
+
+	written, err := d.attachTx(context.Background(), d.Cfg.Topic, job)
+	if !written {
+		err = d.producer.Produce(context.Background(), job)
+	}
+
+	if err == nil {
+		err = item.consumer.Ack(item.message)
+	}
+
+	if err != nil {
+		d.Logger.Error("failed to postpone the delayed job", zap.String("id", item.ID()), zap.Error(err))
+
+		return
+	}
+
+	d.Logger.Debug("delayed job postponed", zap.String("id", item.ID()), zap.Duration("wait", item.wait()))
+}
+
+// requeue writes the job back to the topic. Workers may finish jobs after the pipeline is stopped,
+// then the job is not written and its message is redelivered.
+func (d *Driver) requeue(ctx context.Context, item *Item) error {
+	ctx = propagator.Extract(ctx, propagation.HeaderCarrier(item.headers))
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	deadLetter := d.Cfg.ConsumerOpts.DeadLetter
+	if deadLetter != nil && deadLetter.MaxAttempts > 0 && item.attempts() > deadLetter.MaxAttempts {
+		return d.writeDeadLetter(ctx, item, fmt.Sprintf("max attempts exceeded: %d", deadLetter.MaxAttempts))
+	}
+
+	if !d.Cfg.HasProducer() {
+		return errors.Str("failed to requeue the job, the pipeline is consumer-only (producer: false)")
+	}
+
+	if d.producer == nil {
+		return errors.Errorf("failed to requeue the job, the pipeline is %s", d.state)
+	}
+
+	if written, err := d.attachTx(ctx, d.Cfg.Topic, item); written {
+		return err
+	}
+
+	return d.producer.Produce(ctx, item)
+}
+
+// attachTx adds the job to the transaction of its message when the pipeline consumes in transactions, so the job
+// is written only if the transaction commits and is not duplicated when the message is redelivered after a rollback.
+// It reports false in the commit mode, the job is then written by the caller.
+func (d *Driver) attachTx(ctx context.Context, topic string, item *Item) (bool, error) {
+	c, ok := item.consumer.(*txConsumer)
+	if !ok {
+		return false, nil
+	}
+
+	message, err := encode(ctx, item)
+	if err != nil {
+		return true, err
+	}
+
+	return true, c.Write(item.message, topic, message)
+}
+
+// moveToDeadLetter writes the job to the dead-letter topic with the failure reason and the source position.
+func (d *Driver) moveToDeadLetter(ctx context.Context, item *Item, reason string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.writeDeadLetter(ctx, item, reason)
+}
+
+// writeDeadLetter must be called with the lifecycle lock held.
+func (d *Driver) writeDeadLetter(ctx context.Context, item *Item, reason string) error {
+	if d.deadLetter == nil {
+		return errors.Errorf("failed to move the job to the dead-letter topic, the pipeline is %s", d.state)
+	}
+
+	item.headers[deadLetterErrorHeader] = []string{reason}
+	item.headers[deadLetterTopicHeader] = []string{item.Options.Queue}
+	item.headers[deadLetterPartitionHeader] = []string{strconv.FormatInt(int64(item.Options.Partition), 10)}
+	item.headers[deadLetterOffsetHeader] = []string{strconv.FormatInt(item.Options.Offset, 10)}
+	// the job is processed as soon as it is replayed from the dead-letter topic
+	item.Options.Delay = 0
+	item.Options.NotBefore = 0
+
+	topic := d.Cfg.ConsumerOpts.DeadLetter.Topic
+
+	written, err := d.attachTx(ctx, topic, item)
+	if !written {
+		err = d.deadLetter.Produce(ctx, item)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	d.Logger.Warn("job moved to the dead-letter topic",
+		zap.String("id", item.ID()),
+		zap.String("topic", topic),
+		zap.String("reason", reason),
+	)
 
 	return nil
 }
@@ -170,11 +647,44 @@ func (d *Driver) Resume(ctx context.Context, pipeline string) error {
 func (d *Driver) State(ctx context.Context) (*jobs.State, error) {
 	pipe := *d.Pipeline.Load()
 
-	return &jobs.State{
+	d.mu.RLock()
+	lifecycle, runErr, consumer, sched := d.state, d.runErr, d.consumer, d.scheduler
+	d.mu.RUnlock()
+
+	state := &jobs.State{
 		Priority: uint64(pipe.Priority()),
 		Pipeline: pipe.Name(),
 		Driver:   pipe.Driver(),
 		Queue:    d.Cfg.Topic,
-		Ready:    atomic.LoadUint32(&d.ready) > 0,
-	}, nil
+		Ready:    lifecycle == stateRunning,
+	}
+
+	if runErr != nil {
+		state.ErrorMessage = runErr.Error()
+	}
+
+	if consumer == nil {
+		return state, nil
+	}
+
+	stats, err := d.stats(ctx, consumer, sched)
+	if err != nil {
+		// the lag is not reported, the rest of the state is still useful
+		d.Logger.Warn("failed to get the consumer lag", zap.Error(err))
+	}
+
+	state.Active = stats.InFlight - stats.Delayed
+	state.Delayed = stats.Delayed
+	state.Reserved = max(stats.Lag-stats.InFlight, 0)
+
+	// the reader is being restarted or the consumer gave up
+	if err := consumer.Err(); err != nil {
+		state.ErrorMessage = err.Error()
+	}
+
+	if consumer.Failed() {
+		state.Ready = false
+	}
+
+	return state, nil
 }
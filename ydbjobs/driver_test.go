@@ -0,0 +1,427 @@
+package ydbjobs
+
+import (
+	"context"
+	"errors"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testPipeline struct {
+	jobs.Pipeline
+}
+
+func (p testPipeline) Name() string    { return "test" }
+func (p testPipeline) Driver() string  { return pluginName }
+func (p testPipeline) Priority() int64 { return 10 }
+
+type testJob struct {
+	jobs.Message
+}
+
+func (j testJob) Name() string                 { return "job" }
+func (j testJob) ID() string                   { return "id" }
+func (j testJob) Payload() []byte              { return []byte("payload") }
+func (j testJob) Headers() map[string][]string { return nil }
+func (j testJob) Priority() int64              { return 10 }
+func (j testJob) GroupID() string              { return "test" }
+func (j testJob) Delay() int64                 { return 0 }
+func (j testJob) AutoAck() bool                { return false }
+func (j testJob) Topic() string                { return "jobs" }
+func (j testJob) Metadata() string             { return "" }
+
+type testQueue struct {
+	jobs.Queue
+
+	inserted atomic.Int32
+}
+
+func (q *testQueue) Insert(jobs.Job) { q.inserted.Add(1) }
+
+// testClient fails to describe the consumer, so the state is reported without the lag.
+type testClient struct {
+	topic.Client
+
+	describes *atomic.Int32
+}
+
+func (c testClient) DescribeTopicConsumer(
+	ctx context.Context,
+	_ string,
+	_ string,
+	_ ...topicoptions.DescribeConsumerOption,
+) (topictypes.TopicConsumerDescription, error) {
+	if c.describes != nil {
+		c.describes.Add(1)
+
+		if _, ok := ctx.Deadline(); !ok {
+			return topictypes.TopicConsumerDescription{}, errors.New("the describe is not bounded")
+		}
+	}
+
+	return topictypes.TopicConsumerDescription{}, assert.AnError
+}
+
+type testConsumer struct {
+	stopped atomic.Bool
+}
+
+func (c *testConsumer) Start() <-chan *topicreader.Message { return nil }
+func (c *testConsumer) Ack(*topicreader.Message) error     { return nil }
+func (c *testConsumer) Err() error                         { return nil }
+func (c *testConsumer) Failed() bool                       { return false }
+func (c *testConsumer) InFlight() int                      { return 0 }
+func (c *testConsumer) Partitions() []TopicPartition       { return nil }
+func (c *testConsumer) Stop()                              { c.stopped.Store(true) }
+
+// testProducer fails writes once it is stopped, like the topic writer does after Close,
+// and writes of the rejected job IDs.
+type testProducer struct {
+	stopped  atomic.Bool
+	stops    atomic.Int32
+	written  atomic.Int32
+	rejected map[string]bool
+}
+
+func (p *testProducer) Produce(_ context.Context, item *Item) error {
+	if p.stopped.Load() || p.rejected[item.ID()] {
+		return assert.AnError
+	}
+
+	p.written.Add(1)
+
+	return nil
+}
+
+func (p *testProducer) ProduceBatch(ctx context.Context, items []*Item) []error {
+	errs := make([]error, len(items))
+	for i := range items {
+		errs[i] = p.Produce(ctx, items[i])
+	}
+
+	return errs
+}
+
+func (p *testProducer) Stop(context.Context) error {
+	p.stopped.Store(true)
+	p.stops.Add(1)
+
+	return nil
+}
+
+// newTestDriver returns a running driver with fake components.
+func newTestDriver(t *testing.T) (*Driver, *testProducer, *atomic.Int32) {
+	t.Helper()
+
+	producer := &testProducer{}
+	releases := &atomic.Int32{}
+
+	d := &Driver{
+		Cfg: Config{
+			Topic:        "jobs",
+			ConsumerOpts: &ConsumerOpts{Name: "consumer"},
+		},
+		Client: testClient{},
+		Logger: zap.NewNop(),
+		Tracer: noop.NewTracerProvider(),
+		Release: func(context.Context) error {
+			releases.Add(1)
+
+			return nil
+		},
+		newConsumer: func(*scheduler) (Consumer, error) {
+			return &testConsumer{}, nil
+		},
+	}
+
+	var pipe jobs.Pipeline = testPipeline{}
+	d.Pipeline.Store(&pipe)
+
+	d.mu.Lock()
+	require.NoError(t, d.startConsumer())
+	d.producer = producer
+	d.state = stateRunning
+	d.mu.Unlock()
+
+	return d, producer, releases
+}
+
+func TestDriverTransitions(t *testing.T) {
+	d, producer, releases := newTestDriver(t)
+	ctx := context.Background()
+
+	assert.Error(t, d.Run(ctx, testPipeline{}), "a running pipeline must not run again")
+	assert.Error(t, d.Resume(ctx, "test"), "a running pipeline must not be resumed")
+	assert.Error(t, d.Pause(ctx, "unknown"))
+
+	consumer := d.consumer.(*testConsumer)
+
+	require.NoError(t, d.Pause(ctx, "test"))
+	assert.True(t, consumer.stopped.Load())
+	assert.Nil(t, d.consumer)
+	assert.Error(t, d.Pause(ctx, "test"), "a paused pipeline must not be paused again")
+
+	// jobs are pushed to a paused pipeline
+	assert.NoError(t, d.Push(ctx, testJob{}))
+
+	state, err := d.State(ctx)
+	require.NoError(t, err)
+	assert.False(t, state.Ready)
+
+	require.NoError(t, d.Resume(ctx, "test"))
+	assert.NotNil(t, d.consumer)
+
+	state, err = d.State(ctx)
+	require.NoError(t, err)
+	assert.True(t, state.Ready)
+
+	require.NoError(t, d.Stop(ctx))
+	require.NoError(t, d.Stop(ctx), "stop must be idempotent")
+
+	assert.Equal(t, int32(1), producer.stops.Load())
+	assert.Equal(t, int32(1), releases.Load())
+
+	assert.Error(t, d.Push(ctx, testJob{}))
+	assert.Error(t, d.PushBatch(ctx, []jobs.Message{testJob{}}))
+	assert.Error(t, d.Pause(ctx, "test"))
+	assert.Error(t, d.Resume(ctx, "test"))
+	assert.Error(t, d.Run(ctx, testPipeline{}))
+}
+
+type idJob struct {
+	testJob
+
+	id string
+}
+
+func (j idJob) ID() string { return j.id }
+
+func TestDriverPushBatchErrors(t *testing.T) {
+	d, producer, _ := newTestDriver(t)
+	producer.rejected = map[string]bool{"second": true, "fourth": true}
+
+	err := d.PushBatch(context.Background(), []jobs.Message{
+		idJob{id: "first"},
+		idJob{id: "second"},
+		idJob{id: "third"},
+		idJob{id: "fourth"},
+	})
+
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Failed, 2)
+
+	assert.Equal(t, 1, batchErr.Failed[0].Index)
+	assert.Equal(t, "second", batchErr.Failed[0].ID)
+	assert.ErrorIs(t, batchErr.Failed[0].Err, assert.AnError)
+	assert.Equal(t, 3, batchErr.Failed[1].Index)
+	assert.Equal(t, "fourth", batchErr.Failed[1].ID)
+	assert.Equal(t, int32(2), producer.written.Load(), "the rest of the batch is written")
+
+	producer.rejected = nil
+	assert.NoError(t, d.PushBatch(context.Background(), []jobs.Message{idJob{id: "first"}}))
+}
+
+func TestDriverStopFailed(t *testing.T) {
+	d, _, releases := newTestDriver(t)
+	ctx := context.Background()
+
+	d.mu.Lock()
+	_ = d.shutdown(ctx)
+	d.state = stateFailed
+	d.runErr = assert.AnError
+	d.mu.Unlock()
+
+	state, err := d.State(ctx)
+	require.NoError(t, err)
+	assert.False(t, state.Ready)
+	assert.Equal(t, assert.AnError.Error(), state.ErrorMessage)
+
+	assert.Error(t, d.Push(ctx, testJob{}))
+	assert.Error(t, d.Resume(ctx, "test"))
+
+	require.NoError(t, d.Stop(ctx))
+	assert.Equal(t, int32(1), releases.Load())
+}
+
+func TestDriverConcurrentLifecycle(t *testing.T) {
+	d, producer, releases := newTestDriver(t)
+	ctx := context.Background()
+
+	var (
+		wg sync.WaitGroup
+		// writes that reached the stopped producer
+		failures atomic.Int32
+	)
+
+	for range 8 {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				_ = d.Pause(ctx, "test")
+				_ = d.Resume(ctx, "test")
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				// a push must either succeed or be refused, it must not reach the stopped producer
+				if err := d.Push(ctx, testJob{}); errors.Is(err, assert.AnError) {
+					failures.Add(1)
+				}
+
+				_, _ = d.State(ctx)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				// the batch is refused as a whole, failed jobs are reported only by the producer
+				var batchErr *BatchError
+				if err := d.PushBatch(ctx, []jobs.Message{testJob{}, testJob{}}); errors.As(err, &batchErr) {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		assert.NoError(t, d.Stop(ctx))
+	}()
+
+	wg.Wait()
+
+	assert.NoError(t, d.Stop(ctx))
+	assert.Zero(t, failures.Load())
+	assert.Equal(t, int32(1), producer.stops.Load())
+	assert.Equal(t, int32(1), releases.Load())
+	assert.Nil(t, d.consumer)
+	assert.Equal(t, stateStopped, d.state)
+}
+
+func TestDriverStateLagCache(t *testing.T) {
+	d, _, _ := newTestDriver(t)
+	ctx := context.Background()
+
+	describes := &atomic.Int32{}
+	d.Client = testClient{describes: describes}
+
+	for range 3 {
+		_, err := d.State(ctx)
+		require.NoError(t, err)
+	}
+
+	_, err := d.Stats(ctx)
+	assert.ErrorContains(t, err, assert.AnError.Error(), "the failure to describe the lag is cached too")
+	assert.Equal(t, int32(1), describes.Load())
+
+	d.lag.mu.Lock()
+	d.lag.updatedAt = time.Now().Add(-lagCacheTTL)
+	d.lag.mu.Unlock()
+
+	_, err = d.Stats(ctx)
+	assert.ErrorContains(t, err, assert.AnError.Error())
+	assert.Equal(t, int32(2), describes.Load())
+}
+
+func TestDriverRequeueAfterStop(t *testing.T) {
+	d, producer, _ := newTestDriver(t)
+	ctx := context.Background()
+
+	d.Cfg.ConsumerOpts.DeadLetter = &DeadLetterOpts{Topic: "dead-letter"}
+	deadLetter := &testProducer{}
+
+	d.mu.Lock()
+	d.deadLetter = deadLetter
+	d.mu.Unlock()
+
+	newItem := func() *Item {
+		return &Item{
+			Job:          "job",
+			Ident:        "id",
+			headers:      map[string][]string{},
+			Options:      &Options{},
+			consumer:     &testConsumer{},
+			requeueFn:    d.requeue,
+			deadLetterFn: d.moveToDeadLetter,
+		}
+	}
+
+	require.NoError(t, newItem().Requeue(nil, 0))
+	require.NoError(t, newItem().Nack())
+	assert.Equal(t, int32(1), producer.written.Load())
+	assert.Equal(t, int32(1), deadLetter.written.Load())
+
+	require.NoError(t, d.Stop(ctx))
+
+	// workers finishing their jobs after the stop get an error instead of a crash
+	assert.Error(t, newItem().Requeue(nil, 0))
+	assert.Error(t, newItem().Nack())
+	assert.Error(t, newItem().NackWithOptions(true, 10))
+	assert.Equal(t, int32(1), producer.written.Load())
+	assert.Equal(t, int32(1), deadLetter.written.Load())
+
+	// the delayed job is left for redelivery
+	d.postpone(newItem())
+	assert.Equal(t, int32(1), producer.written.Load())
+}
+
+func TestDriverExpireConsumerOnly(t *testing.T) {
+	d, _, _ := newTestDriver(t)
+	queue := &testQueue{}
+	deadLetter := &testProducer{}
+	producer := false
+
+	d.mu.Lock()
+	d.Cfg.Producer = &producer
+	d.producer = nil
+	d.deadLetter = deadLetter
+	d.Queue = queue
+	d.mu.Unlock()
+
+	newItem := func() *Item {
+		return &Item{
+			Job:      "job",
+			Ident:    "id",
+			headers:  map[string][]string{},
+			Options:  &Options{Delay: 3600, NotBefore: notBefore(3600)},
+			consumer: &testConsumer{},
+		}
+	}
+
+	// without the dead-letter topic the job is delivered early
+	d.expire(newItem())
+	assert.Equal(t, int32(1), queue.inserted.Load())
+	assert.Zero(t, deadLetter.written.Load())
+
+	d.Cfg.ConsumerOpts.DeadLetter = &DeadLetterOpts{Topic: "dead-letter"}
+
+	item := newItem()
+	d.expire(item)
+	assert.Equal(t, int32(1), queue.inserted.Load())
+	assert.Equal(t, int32(1), deadLetter.written.Load())
+	assert.Zero(t, item.Options.NotBefore, "the dead-letter job is not delayed")
+	assert.Zero(t, item.Options.Delay)
+}
@@ -2,94 +2,207 @@ package ydbjobs
 
 import (
 	"context"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
-	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"os"
 	"time"
 )
 
 func BuildConsumer(
 	client topic.Client,
 	logger *zap.Logger,
-	topic string,
-	consumerName string,
-	handler func(*topicreader.Message) error,
+	metrics *pipelineMetrics,
+	tracer trace.TracerProvider,
+	selectors topicoptions.ReadSelectors,
+	opts *ConsumerOpts,
+	initTimeout time.Duration,
+	handler func(*topicreader.Message, Consumer) error,
 ) (Consumer, error) {
-	reader, err := client.StartReader(
-		consumerName,
-		topicoptions.ReadSelectors{
-			topicoptions.ReadSelector{
-				Path: topic,
-			},
-		},
-		topicoptions.WithReaderCommitMode(topicoptions.CommitModeSync),
-	)
+	assigned := newAssignedPartitions(metrics.partitions)
+	connect := readerConnector(client, metrics, selectors, assigned, opts, initTimeout)
 
+	reader, err := connect(context.Background())
 	if err != nil {
+		logger.Error("failed to start reader", zap.Error(err))
+
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	c := NewConsumer(reader, connect, opts, assigned, logger, metrics, tracer)
+
+	logger.Info("consumer ready",
+		zap.String("consumer_name", opts.Name),
+		zap.Strings("topics", selectorPaths(selectors)),
+		zap.Int("max_in_flight", opts.MaxInFlight),
+		zap.String("ordering", opts.Ordering),
+	)
+
+	go consume(c, logger, handler)
+
+	return c, nil
+}
+
+// BuildTxConsumer starts a consumer that reads messages within transactions, see txConsumer.
+func BuildTxConsumer(
+	client topic.Client,
+	queryClient query.Client,
+	write func(ctx context.Context, tx query.TxActor, topic string, messages []topicwriter.Message) error,
+	logger *zap.Logger,
+	metrics *pipelineMetrics,
+	tracer trace.TracerProvider,
+	selectors topicoptions.ReadSelectors,
+	opts *ConsumerOpts,
+	initTimeout time.Duration,
+	handler func(*topicreader.Message, Consumer) error,
+) (Consumer, error) {
+	assigned := newAssignedPartitions(metrics.partitions)
+	connect := readerConnector(client, metrics, selectors, assigned, opts, initTimeout)
 
-	if err := reader.WaitInit(ctx); err != nil {
-		logger.Error("failed to wait for reader initialization", zap.Error(err))
+	reader, err := connect(context.Background())
+	if err != nil {
+		logger.Error("failed to start reader", zap.Error(err))
 
 		return nil, err
 	}
 
-	c := NewConsumer(reader, logger)
+	c := NewTxConsumer(reader, connect, queryClient, write, opts, assigned, logger, metrics, tracer)
 
-	logger.Info("consumer ready",
-		zap.String("consumer_name", consumerName),
-		zap.String("topic", topic),
+	logger.Info("transactional consumer ready",
+		zap.String("consumer_name", opts.Name),
+		zap.Strings("topics", selectorPaths(selectors)),
+		zap.Int("tx_batch_size", opts.TxBatchSize),
 	)
 
-	go func() {
-		for record := range c.Start() {
-			err := handler(record)
+	go consume(c, logger, handler)
 
-			if err != nil {
-				logger.Error("failed to handle record", zap.Error(err))
-			}
+	return c, nil
+}
+
+// readerConnector returns the function starting a reader of the topics, it is called again to restart a failed reader.
+func readerConnector(
+	client topic.Client,
+	metrics *pipelineMetrics,
+	selectors topicoptions.ReadSelectors,
+	assigned *assignedPartitions,
+	opts *ConsumerOpts,
+	initTimeout time.Duration,
+) func(ctx context.Context) (*topicreader.Reader, error) {
+	return func(ctx context.Context) (*topicreader.Reader, error) {
+		// commits of the acknowledged messages are buffered and merged into ranges by the reader,
+		// a commit lost on a failure only makes the messages redelivered
+		options := append(readerCodecOptions(),
+			topicoptions.WithReaderCommitMode(topicoptions.CommitModeAsync),
+			topicoptions.WithReaderTrace(metrics.readerTrace()),
+			topicoptions.WithReaderTrace(assigned.trace()),
+		)
+		if opts.BufferBytes > 0 {
+			options = append(options, topicoptions.WithReaderBufferSizeBytes(opts.BufferBytes))
 		}
-	}()
 
-	return c, nil
+		reader, err := client.StartReader(opts.Name, selectors, options...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, initTimeout)
+		defer cancel()
+
+		if err := reader.WaitInit(ctx); err != nil {
+			_ = reader.Close(context.Background())
+
+			return nil, err
+		}
+
+		return reader, nil
+	}
+}
+
+func selectorPaths(selectors topicoptions.ReadSelectors) []string {
+	paths := make([]string, len(selectors))
+	for i, selector := range selectors {
+		paths[i] = selector.Path
+	}
+
+	return paths
+}
+
+func consume(c Consumer, logger *zap.Logger, handler func(*topicreader.Message, Consumer) error) {
+	for record := range c.Start() {
+		err := handler(record, c)
+
+		if err != nil {
+			logger.Error("failed to handle record", zap.Error(err))
+		}
+	}
+}
+
+// defaultProducerID is stable across restarts, so the sequence numbers continue from the ones stored by YDB.
+// Pipelines with the same name on one host must set distinct producer IDs.
+func defaultProducerID(pipeline string) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "roadrunner"
+	}
+
+	return host + "-" + pipeline
 }
 
 func BuildProducer(
 	client topic.Client,
 	logger *zap.Logger,
+	metrics *pipelineMetrics,
 	topic string,
 	producerId string,
+	opts *ProducerOpts,
+	initTimeout time.Duration,
 ) (Producer, error) {
-	writer, err := client.StartWriter(topic,
-		topicoptions.WithWriterCodec(topictypes.CodecGzip),
-		topicoptions.WithWriterWaitServerAck(false),
+	options, err := writerCodecOptions(opts.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	// in the server ack mode the writer returns from Write once the server acknowledged the messages,
+	// sequence numbers are assigned by the producer continuing from the last one stored for the producer ID
+	options = append(options,
+		topicoptions.WithWriterWaitServerAck(opts.Ack == AckServer),
+		topicoptions.WithWriterSetAutoSeqNo(false),
 		topicoptions.WithWriterProducerID(producerId),
+		topicoptions.WithWriterTrace(metrics.writerTrace()),
 	)
 
+	if opts.BufferSize > 0 {
+		options = append(options, topicoptions.WithWriterMaxQueueLen(opts.BufferSize))
+	}
+
+	writer, err := client.StartWriter(topic, options...)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), initTimeout)
 	defer cancel()
 
-	if err := writer.WaitInit(ctx); err != nil {
+	info, err := writer.WaitInitInfo(ctx)
+	if err != nil {
 		logger.Error("failed to wait for writer initialization", zap.Error(err))
 
 		return nil, err
 	}
 
-	p := NewProducer(writer, logger)
+	p := NewProducer(writer, logger, metrics, info.LastSeqNum, opts)
 
 	logger.Info("producer ready",
 		zap.String("producer_id", producerId),
 		zap.String("topic", topic),
+		zap.String("ack", opts.Ack),
+		zap.String("codec", opts.Codec),
+		zap.Int64("last_seq_no", info.LastSeqNum),
 	)
 
 	return p, nil
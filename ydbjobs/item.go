@@ -1,16 +1,29 @@
 package ydbjobs
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
 	"io"
 	"strconv"
+	"time"
 )
 
 const (
 	defaultJobName      = "deduced_by_rr"
 	defaultPipelineName = "deduced_by_rr"
 	defaultPriority     = int64(10)
+
+	attemptsHeader = "rr_attempts"
+	// notBeforeKey holds the unix time in milliseconds before which a delayed job must not be processed
+	notBeforeKey = "rr_not_before"
+
+	deadLetterErrorHeader     = "rr_dead_letter_error"
+	deadLetterTopicHeader     = "rr_dead_letter_topic"
+	deadLetterPartitionHeader = "rr_dead_letter_partition"
+	deadLetterOffsetHeader    = "rr_dead_letter_offset"
 )
 
 type Item struct {
@@ -19,12 +32,19 @@ type Item struct {
 	Payload []byte `json:"payload"`
 	headers map[string][]string
 	Options *Options `json:"options,omitempty"`
+
+	message   *topicreader.Message
+	consumer  Consumer
+	requeueFn func(context.Context, *Item) error
+	// deadLetterFn is set when the pipeline has a dead-letter topic
+	deadLetterFn func(context.Context, *Item, string) error
 }
 
 type Options struct {
 	Priority  int64  `json:"priority"`
 	Pipeline  string `json:"pipeline,omitempty"`
 	Delay     int64  `json:"delay,omitempty"`
+	NotBefore int64  `json:"not_before,omitempty"`
 	AutoAck   bool   `json:"auto_ack"`
 	Queue     string
 	Metadata  string
@@ -85,25 +105,46 @@ func (i *Item) Context() ([]byte, error) {
 }
 
 func (i *Item) Ack() error {
-	return nil
+	if i.consumer == nil || i.Options.AutoAck {
+		return nil
+	}
+
+	return i.consumer.Ack(i.message)
 }
 
+// Nack discards the job: the offset is committed and the message is not redelivered.
+// When the pipeline has a dead-letter topic, the job is written there first.
 func (i *Item) Nack() error {
-	return nil
+	if i.consumer == nil || i.Options.AutoAck {
+		return nil
+	}
+
+	if i.deadLetterFn != nil {
+		if err := i.deadLetterFn(context.Background(), i.Copy(), "job was negatively acknowledged"); err != nil {
+			return err
+		}
+	}
+
+	return i.consumer.Ack(i.message)
 }
 
-func (i *Item) NackWithOptions(_ bool, _ int) error {
-	return nil
+func (i *Item) NackWithOptions(requeue bool, delay int) error {
+	if requeue {
+		return i.Requeue(nil, delay)
+	}
+
+	return i.Nack()
 }
 
 func (i *Item) Copy() *Item {
 	item := new(Item)
 	*item = *i
 
-	*item.Options = Options{
+	item.Options = &Options{
 		Priority:  i.Options.Priority,
 		Pipeline:  i.Options.Pipeline,
 		Delay:     i.Options.Delay,
+		NotBefore: i.Options.NotBefore,
 		AutoAck:   i.Options.AutoAck,
 		Queue:     i.Options.Queue,
 		Partition: i.Options.Partition,
@@ -111,23 +152,137 @@ func (i *Item) Copy() *Item {
 		Offset:    i.Options.Offset,
 	}
 
+	item.headers = make(map[string][]string, len(i.headers))
+	for key, value := range i.headers {
+		item.headers[key] = append([]string(nil), value...)
+	}
+
 	return item
 }
 
-func (i *Item) Requeue(headers map[string][]string, _ int) error {
-	return nil
+// Requeue writes the job back to the topic with the merged headers and an incremented attempts counter.
+// The original offset is committed only after the new message is written.
+func (i *Item) Requeue(headers map[string][]string, delay int) error {
+	if i.requeueFn == nil {
+		return errors.New("requeue is not supported for this job")
+	}
+
+	item := i.Copy()
+	for key, value := range headers {
+		item.headers[key] = value
+	}
+
+	item.headers[attemptsHeader] = []string{strconv.Itoa(i.attempts() + 1)}
+	item.Options.Delay = int64(delay)
+	item.Options.NotBefore = notBefore(item.Options.Delay)
+
+	if err := i.requeueFn(context.Background(), item); err != nil {
+		return err
+	}
+
+	if i.consumer == nil || i.Options.AutoAck {
+		return nil
+	}
+
+	return i.consumer.Ack(i.message)
+}
+
+// wait returns how long the delayed job must be held before processing.
+func (i *Item) wait() time.Duration {
+	if i.Options.NotBefore == 0 {
+		return 0
+	}
+
+	return time.Until(time.UnixMilli(i.Options.NotBefore))
+}
+
+func notBefore(delay int64) int64 {
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(time.Duration(delay) * time.Second).UnixMilli()
+}
+
+// attempts returns how many times the job was requeued.
+func (i *Item) attempts() int {
+	value, ok := i.headers[attemptsHeader]
+	if !ok || len(value) == 0 {
+		return 0
+	}
+
+	attempts, err := strconv.Atoi(value[0])
+	if err != nil {
+		return 0
+	}
+
+	return attempts
 }
 
 func (i *Item) Respond(_ []byte, _ string) error {
 	return nil
 }
 
-func fromMessage(msg *topicreader.Message, pipeline string) *Item {
-	headers := make(map[string][]string, len(msg.Metadata))
-	for key, value := range msg.Metadata {
-		headers[key] = []string{string(value)}
+// pack builds topic message metadata: the job attributes are stored under the reserved rr_* keys,
+// so the job survives the topic round-trip unchanged.
+func (i *Item) pack() (map[string][]byte, error) {
+	meta := map[string][]byte{
+		jobs.RRID:       []byte(i.Ident),
+		jobs.RRJob:      []byte(i.Job),
+		jobs.RRPriority: []byte(strconv.FormatInt(i.Options.Priority, 10)),
 	}
 
+	if i.Options.Pipeline != "" {
+		meta[jobs.RRPipeline] = []byte(i.Options.Pipeline)
+	}
+
+	if i.Options.Delay > 0 {
+		meta[jobs.RRDelay] = []byte(strconv.FormatInt(i.Options.Delay, 10))
+	}
+
+	if i.Options.NotBefore > 0 {
+		meta[notBeforeKey] = []byte(strconv.FormatInt(i.Options.NotBefore, 10))
+	}
+
+	if i.Options.AutoAck {
+		meta[jobs.RRAutoAck] = []byte(strconv.FormatBool(i.Options.AutoAck))
+	}
+
+	if len(i.headers) > 0 {
+		headers, err := json.Marshal(i.headers)
+		if err != nil {
+			return nil, err
+		}
+
+		meta[jobs.RRHeaders] = headers
+	}
+
+	return meta, nil
+}
+
+func fromJob(job jobs.Message) *Item {
+	return &Item{
+		Job:     job.Name(),
+		Ident:   job.ID(),
+		Payload: job.Payload(),
+		headers: job.Headers(),
+
+		Options: &Options{
+			Priority:  job.Priority(),
+			Pipeline:  job.GroupID(),
+			Delay:     job.Delay(),
+			NotBefore: notBefore(job.Delay()),
+			AutoAck:   job.AutoAck(),
+			Queue:     job.Topic(),
+			Metadata:  job.Metadata(),
+		},
+	}
+}
+
+// fromMessage restores the job from the topic message. Messages without the rr_job key
+// (written by non-RoadRunner producers) or read in raw mode are converted as is:
+// metadata becomes headers, the job name is deduced and the ID is the message SeqNo.
+func fromMessage(msg *topicreader.Message, consumer Consumer, pipeline string, raw bool) *Item {
 	if pipeline == "" {
 		pipeline = defaultPipelineName
 	}
@@ -136,9 +291,8 @@ func fromMessage(msg *topicreader.Message, pipeline string) *Item {
 
 	item := &Item{
 		Job:     defaultJobName,
-		Ident:   strconv.FormatInt(msg.SeqNo, 10),
+		Ident:   messageID(msg, raw),
 		Payload: data,
-		headers: headers,
 
 		Options: &Options{
 			Priority:  defaultPriority,
@@ -147,7 +301,62 @@ func fromMessage(msg *topicreader.Message, pipeline string) *Item {
 			Queue:     msg.Topic(),
 			Offset:    msg.Offset,
 		},
+
+		message:  msg,
+		consumer: consumer,
+	}
+
+	if _, ok := msg.Metadata[jobs.RRJob]; raw || !ok {
+		item.headers = make(map[string][]string, len(msg.Metadata))
+		for key, value := range msg.Metadata {
+			item.headers[key] = []string{string(value)}
+		}
+
+		return item
+	}
+
+	item.headers = make(map[string][]string)
+	if err := json.Unmarshal(msg.Metadata[jobs.RRHeaders], &item.headers); err != nil {
+		item.headers = make(map[string][]string)
+	}
+
+	for key, value := range msg.Metadata {
+		switch key {
+		case jobs.RRJob:
+			item.Job = string(value)
+		case jobs.RRPriority:
+			if priority, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				item.Options.Priority = priority
+			}
+		case jobs.RRDelay:
+			if delay, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				item.Options.Delay = delay
+			}
+		case notBeforeKey:
+			if notBefore, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+				item.Options.NotBefore = notBefore
+			}
+		case jobs.RRAutoAck:
+			item.Options.AutoAck, _ = strconv.ParseBool(string(value))
+		case jobs.RRID, jobs.RRPipeline, jobs.RRHeaders:
+		default:
+			// metadata added outside the envelope is passed to the worker as headers
+			if _, ok := item.headers[key]; !ok {
+				item.headers[key] = []string{string(value)}
+			}
+		}
 	}
 
 	return item
 }
+
+// messageID returns the job ID of the message: the ID from the envelope or the sequence number of a raw message.
+func messageID(msg *topicreader.Message, raw bool) string {
+	if _, ok := msg.Metadata[jobs.RRJob]; !raw && ok {
+		if id, ok := msg.Metadata[jobs.RRID]; ok {
+			return string(id)
+		}
+	}
+
+	return strconv.FormatInt(msg.SeqNo, 10)
+}
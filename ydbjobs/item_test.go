@@ -0,0 +1,248 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/testutil"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"testing"
+)
+
+func metadataMessage(meta map[string][]byte, payload string) *topicreader.Message {
+	return testutil.NewTopicReaderMessageBuilder().
+		Topic("jobs").
+		PartitionID(2).
+		Offset(7).
+		Seqno(42).
+		Metadata(meta).
+		DataAndUncompressedSize([]byte(payload)).
+		Build()
+}
+
+func TestItemPack(t *testing.T) {
+	item := &Item{
+		Job:     "mail",
+		Ident:   "job-1",
+		Payload: []byte("body"),
+		headers: map[string][]string{"trace": {"a", "b"}},
+		Options: &Options{
+			Priority:  5,
+			Pipeline:  "emails",
+			Delay:     30,
+			NotBefore: 1700000000000,
+			AutoAck:   true,
+		},
+	}
+
+	meta, err := item.pack()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]byte{
+		jobs.RRID:       []byte("job-1"),
+		jobs.RRJob:      []byte("mail"),
+		jobs.RRPriority: []byte("5"),
+		jobs.RRPipeline: []byte("emails"),
+		jobs.RRDelay:    []byte("30"),
+		notBeforeKey:    []byte("1700000000000"),
+		jobs.RRAutoAck:  []byte("true"),
+		jobs.RRHeaders:  []byte(`{"trace":["a","b"]}`),
+	}, meta)
+
+	meta, err = (&Item{Job: "mail", Ident: "job-2", Options: &Options{}}).pack()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]byte{
+		jobs.RRID:       []byte("job-2"),
+		jobs.RRJob:      []byte("mail"),
+		jobs.RRPriority: []byte("0"),
+	}, meta, "optional keys are omitted")
+}
+
+func TestItemFromMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		meta     map[string][]byte
+		pipeline string
+		raw      bool
+
+		id       string
+		job      string
+		priority int64
+		delay    int64
+		autoAck  bool
+		pipe     string
+		headers  map[string][]string
+	}{
+		{
+			name: "envelope",
+			meta: map[string][]byte{
+				jobs.RRID:       []byte("job-1"),
+				jobs.RRJob:      []byte("mail"),
+				jobs.RRPriority: []byte("5"),
+				jobs.RRPipeline: []byte("emails"),
+				jobs.RRDelay:    []byte("30"),
+				jobs.RRAutoAck:  []byte("true"),
+				jobs.RRHeaders:  []byte(`{"trace":["a","b"]}`),
+			},
+			pipeline: "emails",
+			id:       "job-1",
+			job:      "mail",
+			priority: 5,
+			delay:    30,
+			autoAck:  true,
+			pipe:     "emails",
+			headers:  map[string][]string{"trace": {"a", "b"}},
+		},
+		{
+			name: "metadata outside the envelope",
+			meta: map[string][]byte{
+				jobs.RRID:      []byte("job-1"),
+				jobs.RRJob:     []byte("mail"),
+				jobs.RRHeaders: []byte(`{"trace":["a"]}`),
+				"trace":        []byte("ignored"),
+				"source":       []byte("crm"),
+			},
+			pipeline: "emails",
+			id:       "job-1",
+			job:      "mail",
+			priority: defaultPriority,
+			pipe:     "emails",
+			headers:  map[string][]string{"trace": {"a"}, "source": {"crm"}},
+		},
+		{
+			name: "broken headers",
+			meta: map[string][]byte{
+				jobs.RRID:       []byte("job-1"),
+				jobs.RRJob:      []byte("mail"),
+				jobs.RRPriority: []byte("high"),
+				jobs.RRHeaders:  []byte("{"),
+			},
+			pipeline: "emails",
+			id:       "job-1",
+			job:      "mail",
+			priority: defaultPriority,
+			pipe:     "emails",
+			headers:  map[string][]string{},
+		},
+		{
+			name:     "foreign producer",
+			meta:     map[string][]byte{"source": []byte("crm")},
+			id:       "42",
+			job:      defaultJobName,
+			priority: defaultPriority,
+			pipe:     defaultPipelineName,
+			headers:  map[string][]string{"source": {"crm"}},
+		},
+		{
+			name: "raw messages",
+			meta: map[string][]byte{
+				jobs.RRID:  []byte("job-1"),
+				jobs.RRJob: []byte("mail"),
+			},
+			pipeline: "emails",
+			raw:      true,
+			id:       "42",
+			job:      defaultJobName,
+			priority: defaultPriority,
+			pipe:     "emails",
+			headers:  map[string][]string{jobs.RRID: {"job-1"}, jobs.RRJob: {"mail"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := fromMessage(metadataMessage(tt.meta, "body"), nil, tt.pipeline, tt.raw)
+
+			assert.Equal(t, tt.id, item.ID())
+			assert.Equal(t, tt.job, item.Job)
+			assert.Equal(t, []byte("body"), item.Payload)
+			assert.Equal(t, tt.priority, item.Options.Priority)
+			assert.Equal(t, tt.delay, item.Options.Delay)
+			assert.Equal(t, tt.autoAck, item.Options.AutoAck)
+			assert.Equal(t, tt.pipe, item.Options.Pipeline)
+			assert.Equal(t, tt.headers, item.Headers())
+
+			assert.Equal(t, "jobs", item.Options.Queue)
+			assert.Equal(t, int32(2), item.Options.Partition)
+			assert.Equal(t, int64(7), item.Options.Offset)
+		})
+	}
+}
+
+func TestItemRoundTrip(t *testing.T) {
+	item := &Item{
+		Job:     "mail",
+		Ident:   "job-1",
+		Payload: []byte("body"),
+		headers: map[string][]string{"trace": {"a", "b"}, attemptsHeader: {"2"}},
+		Options: &Options{Priority: 5, Pipeline: "emails", Delay: 30, NotBefore: 1700000000000},
+	}
+
+	meta, err := item.pack()
+	require.NoError(t, err)
+
+	restored := fromMessage(metadataMessage(meta, "body"), nil, "emails", false)
+
+	assert.Equal(t, item.Job, restored.Job)
+	assert.Equal(t, item.ID(), restored.ID())
+	assert.Equal(t, item.Payload, restored.Payload)
+	assert.Equal(t, item.Headers(), restored.Headers())
+	assert.Equal(t, item.Options.Priority, restored.Options.Priority)
+	assert.Equal(t, item.Options.Delay, restored.Options.Delay)
+	assert.Equal(t, item.Options.NotBefore, restored.Options.NotBefore)
+	assert.Equal(t, 2, restored.attempts())
+}
+
+func TestItemRequeueTwice(t *testing.T) {
+	var requeued []*Item
+
+	requeue := func(_ context.Context, item *Item) error {
+		requeued = append(requeued, item)
+
+		return nil
+	}
+
+	// redeliver restores the requeued job as it is read back from the topic
+	redeliver := func(item *Item) *Item {
+		meta, err := item.pack()
+		require.NoError(t, err)
+
+		restored := fromMessage(metadataMessage(meta, string(item.Payload)), nil, "emails", false)
+		restored.requeueFn = requeue
+
+		return restored
+	}
+
+	first := &Item{
+		Job:       "mail",
+		Ident:     "job-1",
+		Payload:   []byte("body"),
+		headers:   map[string][]string{"trace": {"a"}},
+		Options:   &Options{Priority: 5, Pipeline: "emails"},
+		requeueFn: requeue,
+	}
+
+	require.NoError(t, first.Requeue(map[string][]string{"reason": {"timeout"}}, 0))
+	require.Len(t, requeued, 1)
+	assert.Equal(t, map[string][]string{"trace": {"a"}}, first.Headers(), "the original job is not changed")
+
+	second := redeliver(requeued[0])
+	assert.Equal(t, 1, second.attempts())
+
+	require.NoError(t, second.Requeue(nil, 5))
+	require.Len(t, requeued, 2)
+
+	third := redeliver(requeued[1])
+	assert.Equal(t, 2, third.attempts())
+	assert.Equal(t, map[string][]string{
+		"trace":        {"a"},
+		"reason":       {"timeout"},
+		attemptsHeader: {"2"},
+	}, third.Headers())
+	assert.Equal(t, "job-1", third.ID())
+	assert.Equal(t, int64(5), third.Options.Priority)
+	assert.Equal(t, int64(5), third.Options.Delay)
+	assert.Positive(t, third.wait())
+}
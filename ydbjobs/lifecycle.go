@@ -0,0 +1,37 @@
+package ydbjobs
+
+// lifecycleState is the state of the pipeline driver. The valid transitions are:
+//
+//	initialized -> running (Run) or failed (Run error)
+//	running     -> paused (Pause)
+//	paused      -> running (Resume)
+//	any         -> stopping -> stopped (Stop)
+type lifecycleState int
+
+const (
+	stateInitialized lifecycleState = iota
+	stateRunning
+	statePaused
+	stateStopping
+	stateStopped
+	stateFailed
+)
+
+func (s lifecycleState) String() string {
+	switch s {
+	case stateInitialized:
+		return "initialized"
+	case stateRunning:
+		return "running"
+	case statePaused:
+		return "paused"
+	case stateStopping:
+		return "stopping"
+	case stateStopped:
+		return "stopped"
+	case stateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,186 @@
+package ydbjobs
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydb-platform/ydb-go-sdk/v3/trace"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	metricsNamespace = "rr"
+	metricsSubsystem = "ydb"
+
+	pipelineLabel = "pipeline"
+	roleLabel     = "role"
+
+	readerRole = "reader"
+	writerRole = "writer"
+)
+
+// Metrics holds the driver collectors shared by all ydb pipelines, every series is labeled with the pipeline name.
+type Metrics struct {
+	written       *prometheus.CounterVec
+	writeErrors   *prometheus.CounterVec
+	writeDuration *prometheus.HistogramVec
+	read          *prometheus.CounterVec
+	commitErrors  *prometheus.CounterVec
+	commitLag     *prometheus.GaugeVec
+	inFlight      *prometheus.GaugeVec
+	partitions    *prometheus.GaugeVec
+	reconnects    *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		written: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "messages_written_total",
+			Help:      "Number of messages written to the topic.",
+		}, []string{pipelineLabel}),
+		writeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "write_errors_total",
+			Help:      "Number of failed topic writes.",
+		}, []string{pipelineLabel}),
+		writeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "write_duration_seconds",
+			Help:      "Topic write latency.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{pipelineLabel}),
+		read: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "messages_read_total",
+			Help:      "Number of messages read from the topic.",
+		}, []string{pipelineLabel}),
+		commitErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "commit_errors_total",
+			Help:      "Number of failed offset commits.",
+		}, []string{pipelineLabel}),
+		commitLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "commit_lag_seconds",
+			Help:      "Time between writing the last committed message and committing its offset.",
+		}, []string{pipelineLabel}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "in_flight_messages",
+			Help:      "Number of messages delivered to the jobs queue but not acknowledged yet.",
+		}, []string{pipelineLabel}),
+		partitions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "assigned_partitions",
+			Help:      "Number of partitions assigned to the reader.",
+		}, []string{pipelineLabel}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "reconnects_total",
+			Help:      "Number of reader and writer stream reconnects.",
+		}, []string{pipelineLabel, roleLabel}),
+	}
+}
+
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.written,
+		m.writeErrors,
+		m.writeDuration,
+		m.read,
+		m.commitErrors,
+		m.commitLag,
+		m.inFlight,
+		m.partitions,
+		m.reconnects,
+	}
+}
+
+// pipelineMetrics is the set of collectors bound to a single pipeline.
+type pipelineMetrics struct {
+	written          prometheus.Counter
+	writeErrors      prometheus.Counter
+	writeDuration    prometheus.Observer
+	read             prometheus.Counter
+	commitErrors     prometheus.Counter
+	commitLag        prometheus.Gauge
+	inFlight         prometheus.Gauge
+	partitions       prometheus.Gauge
+	readerReconnects prometheus.Counter
+	writerReconnects prometheus.Counter
+}
+
+func (m *Metrics) pipeline(name string) *pipelineMetrics {
+	return &pipelineMetrics{
+		written:          m.written.WithLabelValues(name),
+		writeErrors:      m.writeErrors.WithLabelValues(name),
+		writeDuration:    m.writeDuration.WithLabelValues(name),
+		read:             m.read.WithLabelValues(name),
+		commitErrors:     m.commitErrors.WithLabelValues(name),
+		commitLag:        m.commitLag.WithLabelValues(name),
+		inFlight:         m.inFlight.WithLabelValues(name),
+		partitions:       m.partitions.WithLabelValues(name),
+		readerReconnects: m.reconnects.WithLabelValues(name, readerRole),
+		writerReconnects: m.reconnects.WithLabelValues(name, writerRole),
+	}
+}
+
+// readerTrace counts reader reconnects. The initial connection has no reason and is not counted, the end of
+// a reconnect is reported twice with the same reason, so every reason is counted once.
+func (m *pipelineMetrics) readerTrace() trace.Topic {
+	var (
+		mu   sync.Mutex
+		last error
+	)
+
+	return trace.Topic{
+		OnReaderReconnect: func(start trace.TopicReaderReconnectStartInfo) func(trace.TopicReaderReconnectDoneInfo) {
+			if start.Reason == nil {
+				return nil
+			}
+
+			return func(done trace.TopicReaderReconnectDoneInfo) {
+				if done.Error != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if last != nil && errors.Is(start.Reason, last) {
+					return
+				}
+
+				last = start.Reason
+				m.readerReconnects.Inc()
+			}
+		},
+	}
+}
+
+// writerTrace counts writer reconnects, the initial connection is not counted.
+func (m *pipelineMetrics) writerTrace() trace.Topic {
+	var connected atomic.Bool
+
+	return trace.Topic{
+		OnWriterReconnect: func(
+			trace.TopicWriterReconnectStartInfo,
+		) func(trace.TopicWriterReconnectConnectedInfo) func(trace.TopicWriterReconnectDoneInfo) {
+			if connected.Swap(true) {
+				m.writerReconnects.Inc()
+			}
+
+			return nil
+		},
+	}
+}
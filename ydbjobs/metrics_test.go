@@ -0,0 +1,49 @@
+package ydbjobs
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/trace"
+	"testing"
+)
+
+func TestReaderTraceReconnects(t *testing.T) {
+	metrics := NewMetrics().pipeline("test")
+	hook := metrics.readerTrace().OnReaderReconnect
+
+	reconnect := func(reason, err error) {
+		if done := hook(trace.TopicReaderReconnectStartInfo{Reason: reason}); done != nil {
+			done(trace.TopicReaderReconnectDoneInfo{Error: err})
+		}
+	}
+
+	// the initial connection is reported twice without a reason
+	reconnect(nil, nil)
+	reconnect(nil, nil)
+	assert.Zero(t, counterValue(t, metrics.readerReconnects))
+
+	lost := errors.New("stream lost")
+	reconnect(lost, nil)
+	reconnect(lost, nil)
+	assert.Equal(t, float64(1), counterValue(t, metrics.readerReconnects))
+
+	again := errors.New("stream lost again")
+	reconnect(again, errors.New("unavailable"))
+	assert.Equal(t, float64(1), counterValue(t, metrics.readerReconnects), "a failed reconnect is not counted")
+
+	reconnect(again, nil)
+	reconnect(again, nil)
+	assert.Equal(t, float64(2), counterValue(t, metrics.readerReconnects))
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+
+	var metric dto.Metric
+	require.NoError(t, counter.Write(&metric))
+
+	return metric.GetCounter().GetValue()
+}
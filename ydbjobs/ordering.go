@@ -0,0 +1,208 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"sync"
+)
+
+// orderingKey identifies the messages delivered in order. Message groups and producers are keyed within
+// the partition, so messages without a group or a producer ID are ordered by the partition.
+type orderingKey struct {
+	partitionKey
+	group string
+}
+
+type orderedKey struct {
+	inFlight int
+	pending  []*topicreader.Message
+}
+
+// orderingGate delivers at most limit messages of each key at a time in the read order, the next message
+// of the key is released when one of the delivered messages is acknowledged. Keys are delivered independently,
+// so a slow job holds back only the messages of its key, the messages of other keys and partitions are released
+// as they are read. The waiting messages are bounded by the max_in_flight limit of the consumer.
+type orderingGate struct {
+	mode  string
+	limit int
+
+	mu        sync.Mutex
+	keys      map[orderingKey]*orderedKey
+	delivered map[*topicreader.Message]orderingKey
+	// offsets are the last added offsets of the partitions, a lower one means the partition is re-read
+	offsets map[partitionKey]int64
+	// pending is the number of messages waiting for their keys
+	pending int
+	ready   []*topicreader.Message
+	notify  chan struct{}
+}
+
+func newOrderingGate(mode string, limit int) *orderingGate {
+	return &orderingGate{
+		mode:      mode,
+		limit:     limit,
+		keys:      make(map[orderingKey]*orderedKey),
+		delivered: make(map[*topicreader.Message]orderingKey),
+		offsets:   make(map[partitionKey]int64),
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+func (g *orderingGate) key(msg *topicreader.Message) orderingKey {
+	key := orderingKey{partitionKey: keyOf(msg)}
+
+	switch g.mode {
+	case OrderingMessageGroup:
+		key.group = msg.MessageGroupID
+	case OrderingProducer:
+		key.group = msg.ProducerID
+	}
+
+	return key
+}
+
+// Add queues the read message, it is released by Next once fewer than limit messages of its key are in flight.
+func (g *orderingGate) Add(msg *topicreader.Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	partition := keyOf(msg)
+	if last, ok := g.offsets[partition]; ok && msg.Offset <= last {
+		g.purge(partition)
+	}
+
+	g.offsets[partition] = msg.Offset
+
+	key := g.key(msg)
+	k, ok := g.keys[key]
+	if !ok {
+		k = &orderedKey{}
+		g.keys[key] = k
+	}
+
+	if k.inFlight < g.limit && len(k.pending) == 0 {
+		g.release(key, k, msg)
+
+		return
+	}
+
+	k.pending = append(k.pending, msg)
+	g.pending++
+}
+
+// Done releases the next message of the key of the acknowledged message.
+func (g *orderingGate) Done(msg *topicreader.Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key, ok := g.delivered[msg]
+	if !ok {
+		return
+	}
+
+	delete(g.delivered, msg)
+
+	k := g.keys[key]
+	k.inFlight--
+
+	if len(k.pending) > 0 {
+		next := k.pending[0]
+		k.pending = k.pending[1:]
+		g.pending--
+
+		g.release(key, k, next)
+
+		return
+	}
+
+	if k.inFlight == 0 {
+		delete(g.keys, key)
+	}
+}
+
+func (g *orderingGate) release(key orderingKey, k *orderedKey, msg *topicreader.Message) {
+	k.inFlight++
+	g.delivered[msg] = key
+	g.ready = append(g.ready, msg)
+
+	select {
+	case g.notify <- struct{}{}:
+	default:
+	}
+}
+
+// purge drops the queued messages of the re-read partition, they are delivered again by the reader.
+// Messages already delivered keep their keys busy until they are acknowledged.
+func (g *orderingGate) purge(partition partitionKey) {
+	for key, k := range g.keys {
+		if key.partitionKey != partition {
+			continue
+		}
+
+		g.pending -= len(k.pending)
+		k.pending = nil
+	}
+
+	ready := g.ready[:0]
+	for _, msg := range g.ready {
+		if keyOf(msg) != partition {
+			ready = append(ready, msg)
+
+			continue
+		}
+
+		key := g.delivered[msg]
+		delete(g.delivered, msg)
+		g.keys[key].inFlight--
+	}
+
+	clear(g.ready[len(ready):])
+	g.ready = ready
+
+	for key, k := range g.keys {
+		if key.partitionKey == partition && k.inFlight == 0 {
+			delete(g.keys, key)
+		}
+	}
+}
+
+// Next waits for a released message, it returns false when the context is canceled.
+func (g *orderingGate) Next(ctx context.Context) (*topicreader.Message, bool) {
+	for {
+		g.mu.Lock()
+		if len(g.ready) > 0 {
+			msg := g.ready[0]
+			g.ready = g.ready[1:]
+			g.mu.Unlock()
+
+			return msg, true
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-g.notify:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Pending returns the number of read messages waiting for their keys.
+func (g *orderingGate) Pending() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.pending
+}
+
+// Reset forgets all messages, used when the reader is restarted and they are going to be redelivered.
+func (g *orderingGate) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	clear(g.keys)
+	clear(g.delivered)
+	clear(g.offsets)
+	g.pending = 0
+	g.ready = nil
+}
@@ -0,0 +1,170 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/testutil"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"testing"
+)
+
+func testMessage(partition int64, offset int64, group string) *topicreader.Message {
+	return testutil.NewTopicReaderMessageBuilder().
+		Topic("jobs").
+		PartitionID(partition).
+		Offset(offset).
+		MessageGroupID(group).
+		Build()
+}
+
+// released takes the messages released by the gate without waiting.
+func released(g *orderingGate) []*topicreader.Message {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	messages := g.ready
+	g.ready = nil
+
+	return messages
+}
+
+func TestOrderingGatePartition(t *testing.T) {
+	g := newOrderingGate(OrderingPartition, 1)
+
+	first, second, third := testMessage(0, 1, ""), testMessage(0, 2, ""), testMessage(0, 3, "")
+	other := testMessage(1, 1, "")
+
+	g.Add(first)
+	g.Add(second)
+	g.Add(third)
+	g.Add(other)
+
+	next, ok := g.Next(context.Background())
+	require.True(t, ok)
+	assert.Same(t, first, next)
+	assert.Equal(t, []*topicreader.Message{other}, released(g), "partitions are delivered independently")
+	assert.Equal(t, 2, g.Pending())
+
+	g.Done(first)
+	assert.Equal(t, []*topicreader.Message{second}, released(g))
+	assert.Equal(t, 1, g.Pending())
+
+	// a message acknowledged twice or not delivered by the gate doesn't release the key
+	g.Done(first)
+	g.Done(third)
+	assert.Empty(t, released(g))
+
+	g.Done(second)
+	assert.Equal(t, []*topicreader.Message{third}, released(g))
+	assert.Zero(t, g.Pending())
+
+	g.Done(third)
+	g.Done(other)
+	assert.Empty(t, g.keys)
+	assert.Empty(t, g.delivered)
+}
+
+func TestOrderingGateMessageGroup(t *testing.T) {
+	g := newOrderingGate(OrderingMessageGroup, 2)
+
+	a1, a2, a3 := testMessage(0, 1, "a"), testMessage(0, 2, "a"), testMessage(0, 4, "a")
+	b1 := testMessage(0, 3, "b")
+
+	g.Add(a1)
+	g.Add(a2)
+	g.Add(b1)
+	g.Add(a3)
+
+	assert.Equal(t, []*topicreader.Message{a1, a2, b1}, released(g), "two jobs of a group are in flight")
+	assert.Equal(t, 1, g.Pending())
+
+	g.Done(a2)
+	assert.Equal(t, []*topicreader.Message{a3}, released(g))
+}
+
+func TestOrderingGateSaturatedPartition(t *testing.T) {
+	g := newOrderingGate(OrderingPartition, 1)
+
+	// the job of partition 0 is slow, the rest of the partition waits for it
+	slow := testMessage(0, 1, "")
+	g.Add(slow)
+
+	for offset := int64(2); offset <= 100; offset++ {
+		g.Add(testMessage(0, offset, ""))
+	}
+
+	assert.Equal(t, []*topicreader.Message{slow}, released(g))
+	assert.Equal(t, 99, g.Pending())
+
+	// messages of the other partition are not held back by the saturated one
+	first, second := testMessage(1, 1, ""), testMessage(1, 2, "")
+	g.Add(first)
+	g.Add(second)
+
+	next, ok := g.Next(context.Background())
+	require.True(t, ok)
+	assert.Same(t, first, next)
+
+	g.Done(first)
+
+	next, ok = g.Next(context.Background())
+	require.True(t, ok)
+	assert.Same(t, second, next)
+	assert.Equal(t, 99, g.Pending())
+
+	g.Done(slow)
+	assert.Len(t, released(g), 1)
+	assert.Equal(t, 98, g.Pending())
+}
+
+func TestOrderingGatePurge(t *testing.T) {
+	g := newOrderingGate(OrderingMessageGroup, 1)
+
+	a1, a2 := testMessage(0, 1, "a"), testMessage(0, 2, "a")
+	b1 := testMessage(0, 3, "b")
+	other := testMessage(1, 1, "a")
+
+	g.Add(a1)
+	assert.Equal(t, []*topicreader.Message{a1}, released(g))
+
+	g.Add(a2)
+	g.Add(b1)
+	g.Add(other)
+	assert.Equal(t, 1, g.Pending())
+
+	// the partition is re-read from the committed offset
+	a1Again := testMessage(0, 1, "a")
+	g.Add(a1Again)
+
+	assert.Equal(t, 1, g.Pending(), "the re-read message waits for the stale one")
+	assert.Equal(t, []*topicreader.Message{other}, released(g),
+		"released messages of the re-read partition are dropped")
+	assert.NotContains(t, g.delivered, b1)
+
+	// the stale message delivered before the re-read keeps its key busy
+	g.Done(a1)
+	assert.Equal(t, []*topicreader.Message{a1Again}, released(g))
+	assert.NotContains(t, g.keys, orderingKey{partitionKey: keyOf(b1), group: "b"})
+}
+
+func TestOrderingGateReset(t *testing.T) {
+	g := newOrderingGate(OrderingPartition, 1)
+
+	first, second := testMessage(0, 1, ""), testMessage(0, 2, "")
+
+	g.Add(first)
+	g.Add(second)
+	g.Reset()
+
+	assert.Zero(t, g.Pending())
+	assert.Empty(t, released(g))
+
+	// acknowledgements of the messages read before the reset are ignored
+	g.Done(first)
+	assert.Empty(t, released(g))
+
+	redelivered := testMessage(0, 1, "")
+	g.Add(redelivered)
+	assert.Equal(t, []*topicreader.Message{redelivered}, released(g))
+}
@@ -0,0 +1,82 @@
+package ydbjobs
+
+import (
+	"cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ydb-platform/ydb-go-sdk/v3/trace"
+	"slices"
+	"sync"
+)
+
+type TopicPartition struct {
+	Topic     string
+	Partition int64
+}
+
+// assignedPartitions keeps the partitions currently assigned to the reader, the gauge reports their number.
+type assignedPartitions struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]struct{}
+	gauge      prometheus.Gauge
+}
+
+func newAssignedPartitions(gauge prometheus.Gauge) *assignedPartitions {
+	return &assignedPartitions{
+		partitions: make(map[partitionKey]struct{}),
+		gauge:      gauge,
+	}
+}
+
+func (a *assignedPartitions) List() []TopicPartition {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]TopicPartition, 0, len(a.partitions))
+	for key := range a.partitions {
+		list = append(list, TopicPartition{Topic: key.topic, Partition: key.partition})
+	}
+
+	slices.SortFunc(list, func(a, b TopicPartition) int {
+		return cmp.Or(cmp.Compare(a.Topic, b.Topic), cmp.Compare(a.Partition, b.Partition))
+	})
+
+	return list
+}
+
+// Reset forgets all partitions, the consumer calls it once the reader is closed and before a new one is started.
+func (a *assignedPartitions) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	clear(a.partitions)
+	a.gauge.Set(0)
+}
+
+func (a *assignedPartitions) trace() trace.Topic {
+	return trace.Topic{
+		OnReaderPartitionReadStartResponse: func(
+			start trace.TopicReaderPartitionReadStartResponseStartInfo,
+		) func(trace.TopicReaderPartitionReadStartResponseDoneInfo) {
+			return func(info trace.TopicReaderPartitionReadStartResponseDoneInfo) {
+				if info.Error != nil {
+					return
+				}
+
+				a.mu.Lock()
+				a.partitions[partitionKey{topic: start.Topic, partition: start.PartitionID}] = struct{}{}
+				a.gauge.Set(float64(len(a.partitions)))
+				a.mu.Unlock()
+			}
+		},
+		OnReaderPartitionReadStopResponse: func(
+			stop trace.TopicReaderPartitionReadStopResponseStartInfo,
+		) func(trace.TopicReaderPartitionReadStopResponseDoneInfo) {
+			return func(trace.TopicReaderPartitionReadStopResponseDoneInfo) {
+				a.mu.Lock()
+				delete(a.partitions, partitionKey{topic: stop.Topic, partition: stop.PartitionID})
+				a.gauge.Set(float64(len(a.partitions)))
+				a.mu.Unlock()
+			}
+		},
+	}
+}
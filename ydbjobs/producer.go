@@ -3,61 +3,215 @@ package ydbjobs
 import (
 	"bytes"
 	"context"
-	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"fmt"
 	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
 	"go.uber.org/zap"
+	"sync"
 	"time"
 )
 
 type Producer interface {
-	Produce(ctx context.Context, msg jobs.Message) error
+	Produce(ctx context.Context, item *Item) error
+	// ProduceBatch writes the items in a single call, the returned slice holds the error of each item
+	ProduceBatch(ctx context.Context, items []*Item) []error
 	Stop(ctx context.Context) error
 }
 
 type producer struct {
-	writer *topicwriter.Writer
-	logger *zap.Logger
+	writer  *topicwriter.Writer
+	logger  *zap.Logger
+	metrics *pipelineMetrics
+	ackMode string
+	timeout time.Duration
+	batcher *batcher
+
+	// mu keeps sequence numbers increasing in the order messages are put into the writer
+	mu    sync.Mutex
+	seqNo int64
 }
 
 func NewProducer(
 	writer *topicwriter.Writer,
 	logger *zap.Logger,
+	metrics *pipelineMetrics,
+	lastSeqNo int64,
+	opts *ProducerOpts,
 ) Producer {
-	return &producer{
-		writer: writer,
-		logger: logger,
+	p := &producer{
+		writer:  writer,
+		logger:  logger,
+		metrics: metrics,
+		ackMode: opts.Ack,
+		timeout: opts.PushTimeout,
+		seqNo:   lastSeqNo,
+	}
+
+	if opts.BatchSize > 1 {
+		p.batcher = newBatcher(p.send, opts.BatchSize, opts.BatchBytes, opts.FlushInterval, opts.PushTimeout)
 	}
+
+	return p
 }
 
-func (p producer) Produce(ctx context.Context, msg jobs.Message) error {
-	writeCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+func (p *producer) Produce(ctx context.Context, item *Item) error {
+	writeCtx, cancel := context.WithTimeout(ctx, p.timeout)
 	defer cancel()
 
-	meta := make(map[string][]byte, len(msg.Headers()))
-	for key, v := range msg.Headers() {
-		meta[key] = []byte(v[0])
+	meta, err := item.pack()
+	if err != nil {
+		return err
 	}
 
-	err := p.writer.Write(writeCtx, topicwriter.Message{
-		Data:     bytes.NewReader(msg.Payload()),
+	propagator.Inject(ctx, metadataCarrier(meta))
+
+	message := topicwriter.Message{
+		Data:     bytes.NewReader(item.Payload),
 		Metadata: meta,
-	})
+	}
+
+	start := time.Now()
+	seqNo, err := p.write(writeCtx, message, len(item.Payload))
+	p.metrics.writeDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
-		p.logger.Error(err.Error())
+		p.metrics.writeErrors.Inc()
+		p.logger.Error("failed to push message",
+			zap.String("id", item.ID()),
+			zap.Int64("seqno", seqNo),
+			zap.Error(err),
+		)
 
-		return err
+		return fmt.Errorf("failed to push message %s (seqno %d): %w", item.ID(), seqNo, err)
 	}
 
+	p.metrics.written.Inc()
 	p.logger.Debug("message pushed",
-		zap.ByteString("payload", msg.Payload()),
-		zap.Int("payload_size", len(msg.Payload())),
+		zap.String("id", item.ID()),
+		zap.String("job", item.Job),
+		zap.Int64("seqno", seqNo),
+		zap.ByteString("payload", item.Payload),
+		zap.Int("payload_size", len(item.Payload)),
+	)
+
+	return nil
+}
+
+// write puts the message into the writer directly or through the batcher and returns its sequence number.
+// In the server ack mode the writer returns once the server acknowledged the message, in the flush mode
+// the writer is flushed afterwards.
+func (p *producer) write(ctx context.Context, message topicwriter.Message, size int) (int64, error) {
+	var (
+		seqNo int64
+		err   error
 	)
 
+	if p.batcher != nil {
+		seqNo, err = p.batcher.Add(ctx, message, size)
+	} else {
+		seqNo, err = p.send(ctx, []topicwriter.Message{message})
+	}
+
+	if err != nil {
+		return seqNo, err
+	}
+
+	return seqNo, p.flush(ctx)
+}
+
+func (p *producer) flush(ctx context.Context) error {
+	if p.ackMode != AckFlush {
+		return nil
+	}
+
+	if err := p.writer.Flush(ctx); err != nil {
+		return fmt.Errorf("waiting for the flush: %w", err)
+	}
+
 	return nil
 }
 
-func (p producer) Stop(ctx context.Context) error {
+func (p *producer) ProduceBatch(ctx context.Context, items []*Item) []error {
+	writeCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	errs := make([]error, len(items))
+	messages := make([]topicwriter.Message, 0, len(items))
+	// positions of the packed items in the batch
+	indexes := make([]int, 0, len(items))
+
+	for i, item := range items {
+		meta, err := item.pack()
+		if err != nil {
+			errs[i] = err
+
+			continue
+		}
+
+		propagator.Inject(ctx, metadataCarrier(meta))
+
+		messages = append(messages, topicwriter.Message{
+			Data:     bytes.NewReader(item.Payload),
+			Metadata: meta,
+		})
+		indexes = append(indexes, i)
+	}
+
+	if len(messages) == 0 {
+		return errs
+	}
+
+	start := time.Now()
+
+	firstSeqNo, err := p.send(writeCtx, messages)
+	if err == nil {
+		err = p.flush(writeCtx)
+	}
+
+	for n, i := range indexes {
+		item := items[i]
+		seqNo := firstSeqNo + int64(n)
+
+		if err != nil {
+			p.metrics.writeErrors.Inc()
+			errs[i] = fmt.Errorf("failed to push message %s (seqno %d): %w", item.ID(), seqNo, err)
+
+			continue
+		}
+
+		p.metrics.written.Inc()
+		p.logger.Debug("message pushed",
+			zap.String("id", item.ID()),
+			zap.String("job", item.Job),
+			zap.Int64("seqno", seqNo),
+		)
+	}
+
+	p.metrics.writeDuration.Observe(time.Since(start).Seconds())
+
+	return errs
+}
+
+// send numbers the messages and puts them into the writer in a single call, it returns the sequence number
+// of the first message. The writer requires increasing sequence numbers, so the lock is held until the
+// writer returns: in the server ack mode this includes the ack wait, batching lets concurrent pushes share it.
+func (p *producer) send(ctx context.Context, messages []topicwriter.Message) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	first := p.seqNo + 1
+	for i := range messages {
+		p.seqNo++
+		messages[i].SeqNo = p.seqNo
+	}
+
+	return first, p.writer.Write(ctx, messages...)
+}
+
+func (p *producer) Stop(ctx context.Context) error {
+	if p.batcher != nil {
+		p.batcher.Stop()
+	}
+
 	if err := p.writer.Flush(ctx); err != nil {
 		p.logger.Error(err.Error())
 	}
@@ -0,0 +1,66 @@
+package ydbjobs
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler holds delayed jobs in memory until they are due.
+type scheduler struct {
+	mu      sync.Mutex
+	timers  map[*time.Timer]struct{}
+	stopped bool
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		timers: make(map[*time.Timer]struct{}),
+	}
+}
+
+// Schedule calls fn after the provided duration unless the scheduler is stopped before.
+func (s *scheduler) Schedule(after time.Duration, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(after, func() {
+		s.mu.Lock()
+		if _, ok := s.timers[timer]; !ok {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.timers, timer)
+		s.mu.Unlock()
+
+		fn()
+	})
+
+	s.timers[timer] = struct{}{}
+}
+
+// Len returns the number of scheduled calls.
+func (s *scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.timers)
+}
+
+// Stop cancels all scheduled calls, the held messages stay uncommitted and are redelivered.
+func (s *scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+
+	for timer := range s.timers {
+		timer.Stop()
+	}
+
+	clear(s.timers)
+}
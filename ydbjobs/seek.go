@@ -0,0 +1,211 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-genproto/Ydb_Topic_V1"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb_Topic"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"go.uber.org/zap"
+	"slices"
+	"time"
+)
+
+// PartitionOffset is the position of the next message to read from the partition.
+type PartitionOffset struct {
+	Topic     string
+	Partition int64
+	Offset    int64
+}
+
+// seekReadTimeout bounds reading the first messages written since the seek timestamp.
+const seekReadTimeout = 10 * time.Second
+
+// batchReader reads message batches, implemented by *topicreader.Reader.
+type batchReader interface {
+	ReadMessagesBatch(ctx context.Context, opts ...topicreader.ReadBatchOption) (*topicreader.Batch, error)
+}
+
+// Seek moves the pipeline consumer to the messages written since readFrom or to the partition offsets, which are
+// committed for the consumer. The timestamp is resolved to the offset of the first message written since it in each
+// read partition. A running pipeline is paused and resumed with a new reader. Offsets of partitions not listed
+// are left as is.
+func (d *Driver) Seek(ctx context.Context, pipeline string, readFrom time.Time, offsets []PartitionOffset) error {
+	pipe := *d.Pipeline.Load()
+
+	if pipe.Name() != pipeline {
+		return errors.Errorf("no such pipeline: %s", pipe.Name())
+	}
+
+	if d.Cfg.ConsumerOpts == nil {
+		return errors.Str("the pipeline has no consumer options")
+	}
+
+	if readFrom.IsZero() == (len(offsets) == 0) {
+		return errors.Str("either a timestamp or partition offsets must be set")
+	}
+
+	if !readFrom.IsZero() {
+		var err error
+		offsets, err = d.resolveOffsets(ctx, readFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	running := d.state == stateRunning
+	if running {
+		if err := d.pause(); err != nil {
+			return err
+		}
+	} else if d.state != statePaused {
+		return errors.Errorf("failed to seek the pipeline, it is %s", d.state)
+	}
+
+	if err := d.commitOffsets(ctx, offsets); err != nil {
+		return err
+	}
+
+	d.Logger.Info("pipeline consumer moved",
+		zap.String("pipeline", pipeline),
+		zap.Time("read_from", readFrom),
+		zap.Int("partitions", len(offsets)),
+	)
+
+	if !running {
+		return nil
+	}
+
+	return d.resume()
+}
+
+// commitOffsets commits the offsets for the pipeline consumer, unlike the reader commits they may move backwards.
+func (d *Driver) commitOffsets(ctx context.Context, offsets []PartitionOffset) error {
+	client := Ydb_Topic_V1.NewTopicServiceClient(ydb.GRPCConn(d.Driver))
+
+	for _, offset := range offsets {
+		path := d.topicPath(offset.Topic)
+
+		_, err := client.CommitOffset(ctx, &Ydb_Topic.CommitOffsetRequest{
+			Path:        path,
+			PartitionId: offset.Partition,
+			Consumer:    d.Cfg.ConsumerOpts.Name,
+			Offset:      offset.Offset,
+		})
+		if err != nil {
+			return errors.Errorf("failed to commit offset %d of partition %d of topic %s: %v",
+				offset.Offset, offset.Partition, path, err)
+		}
+	}
+
+	return nil
+}
+
+// resolveOffsets returns the offset of the first message written since readFrom in each partition read by
+// the consumer, partitions without such messages are positioned at their end.
+func (d *Driver) resolveOffsets(ctx context.Context, readFrom time.Time) ([]PartitionOffset, error) {
+	var offsets []PartitionOffset
+
+	for _, selector := range d.Cfg.ConsumerOpts.readSelectors(d.Cfg.Topic) {
+		description, err := d.Client.Describe(ctx, selector.Path, topicoptions.IncludePartitionStats())
+		if err != nil {
+			return nil, errors.Errorf("failed to describe topic %s: %v", selector.Path, err)
+		}
+
+		var partitions []topictypes.PartitionInfo
+		// the partitions written since the timestamp are read to find their first offsets
+		var written []int64
+		for _, p := range description.Partitions {
+			if len(selector.Partitions) > 0 && !slices.Contains(selector.Partitions, p.PartitionID) {
+				continue
+			}
+
+			partitions = append(partitions, p)
+
+			stats := p.PartitionStats
+			if stats.LastWriteTime != nil && !stats.LastWriteTime.Before(readFrom) &&
+				stats.PartitionsOffset.End > stats.PartitionsOffset.Start {
+				written = append(written, p.PartitionID)
+			}
+		}
+
+		first := map[int64]int64{}
+		if len(written) > 0 {
+			first, err = d.readFirstOffsets(ctx, selector.Path, written, readFrom)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, p := range partitions {
+			offset, ok := first[p.PartitionID]
+			if !ok {
+				offset = p.PartitionStats.PartitionsOffset.End
+			}
+
+			offsets = append(offsets, PartitionOffset{Topic: selector.Path, Partition: p.PartitionID, Offset: offset})
+		}
+	}
+
+	return offsets, nil
+}
+
+// readFirstOffsets reads the partitions without a consumer from the timestamp to find their first offsets.
+func (d *Driver) readFirstOffsets(
+	ctx context.Context,
+	path string,
+	partitions []int64,
+	readFrom time.Time,
+) (map[int64]int64, error) {
+	selectors := topicoptions.ReadSelectors{{Path: path, Partitions: partitions, ReadFrom: readFrom}}
+
+	reader, err := d.Client.StartReader("", selectors,
+		append(readerCodecOptions(), topicoptions.WithReaderWithoutConsumer(false))...,
+	)
+	if err != nil {
+		return nil, errors.Errorf("failed to read topic %s: %v", path, err)
+	}
+
+	defer func() {
+		_ = reader.Close(context.Background())
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, seekReadTimeout)
+	defer cancel()
+
+	first, err := firstOffsets(ctx, reader, partitions)
+	if err != nil {
+		return nil, errors.Errorf("failed to find the messages of topic %s written since %s: %v", path, readFrom, err)
+	}
+
+	return first, nil
+}
+
+// firstOffsets reads batches until the first offset of each partition is known.
+func firstOffsets(ctx context.Context, reader batchReader, partitions []int64) (map[int64]int64, error) {
+	first := make(map[int64]int64, len(partitions))
+
+	for len(first) < len(partitions) {
+		batch, err := reader.ReadMessagesBatch(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(batch.Messages) == 0 {
+			continue
+		}
+
+		partition := batch.Messages[0].PartitionID()
+		if _, ok := first[partition]; !ok && slices.Contains(partitions, partition) {
+			first[partition] = batch.Messages[0].Offset
+		}
+	}
+
+	return first, nil
+}
@@ -0,0 +1,136 @@
+package ydbjobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"testing"
+	"time"
+)
+
+// testBatchReader returns the batches and then fails like a reader whose context is done.
+type testBatchReader struct {
+	batches []*topicreader.Batch
+}
+
+func (r *testBatchReader) ReadMessagesBatch(
+	context.Context,
+	...topicreader.ReadBatchOption,
+) (*topicreader.Batch, error) {
+	if len(r.batches) == 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	batch := r.batches[0]
+	r.batches = r.batches[1:]
+
+	return batch, nil
+}
+
+func testBatch(partition int64, offsets ...int64) *topicreader.Batch {
+	batch := &topicreader.Batch{}
+	for _, offset := range offsets {
+		batch.Messages = append(batch.Messages, testMessage(partition, offset, ""))
+	}
+
+	return batch
+}
+
+func TestFirstOffsets(t *testing.T) {
+	reader := &testBatchReader{batches: []*topicreader.Batch{
+		testBatch(0, 5, 6),
+		{},
+		testBatch(2, 1),
+		testBatch(0, 7),
+		testBatch(1, 3),
+	}}
+
+	first, err := firstOffsets(context.Background(), reader, []int64{0, 1})
+	require.NoError(t, err)
+	assert.Equal(t, map[int64]int64{0: 5, 1: 3}, first)
+
+	reader = &testBatchReader{batches: []*topicreader.Batch{testBatch(0, 5)}}
+
+	_, err = firstOffsets(context.Background(), reader, []int64{0, 1})
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "a partition written since the timestamp must be read")
+}
+
+// seekClient describes the topic, partitions that need reading can't be read.
+type seekClient struct {
+	topic.Client
+
+	partitions []topictypes.PartitionInfo
+}
+
+func (c seekClient) Describe(
+	context.Context,
+	string,
+	...topicoptions.DescribeOption,
+) (topictypes.TopicDescription, error) {
+	return topictypes.TopicDescription{Partitions: c.partitions}, nil
+}
+
+func (c seekClient) StartReader(
+	string,
+	topicoptions.ReadSelectors,
+	...topicoptions.ReaderOption,
+) (*topicreader.Reader, error) {
+	return nil, assert.AnError
+}
+
+func TestResolveOffsets(t *testing.T) {
+	readFrom := time.Now().Add(-time.Hour)
+	before := readFrom.Add(-time.Minute)
+	after := readFrom.Add(time.Minute)
+
+	partition := func(id int64, start, end int64, lastWrite *time.Time) topictypes.PartitionInfo {
+		return topictypes.PartitionInfo{
+			PartitionID: id,
+			PartitionStats: topictypes.PartitionStats{
+				PartitionsOffset: topictypes.OffsetRange{Start: start, End: end},
+				LastWriteTime:    lastWrite,
+			},
+		}
+	}
+
+	d, _, _ := newTestDriver(t)
+	client := seekClient{partitions: []topictypes.PartitionInfo{
+		partition(0, 0, 10, &before),
+		partition(1, 5, 5, nil),
+		partition(2, 0, 20, &after),
+	}}
+	d.Client = client
+
+	// the partitions not written since the timestamp are positioned at their end instead of the offset 0
+	d.Cfg.ConsumerOpts.Topics = []*TopicSelector{{Path: "jobs", Partitions: []int64{0, 1}}}
+
+	offsets, err := d.resolveOffsets(context.Background(), readFrom)
+	require.NoError(t, err)
+	assert.Equal(t, []PartitionOffset{
+		{Topic: "jobs", Partition: 0, Offset: 10},
+		{Topic: "jobs", Partition: 1, Offset: 5},
+	}, offsets)
+
+	// the written partition is read to find its first offset
+	d.Cfg.ConsumerOpts.Topics = nil
+
+	_, err = d.resolveOffsets(context.Background(), readFrom)
+	assert.ErrorContains(t, err, "failed to read topic jobs")
+}
+
+func TestSeekValidation(t *testing.T) {
+	d, _, _ := newTestDriver(t)
+	ctx := context.Background()
+
+	assert.Error(t, d.Seek(ctx, "unknown", time.Now(), nil))
+	assert.Error(t, d.Seek(ctx, "test", time.Time{}, nil), "either a timestamp or offsets are required")
+	assert.Error(t, d.Seek(ctx, "test", time.Now(), []PartitionOffset{{Partition: 0, Offset: 1}}))
+
+	require.NoError(t, d.Stop(ctx))
+	assert.ErrorContains(t, d.Seek(ctx, "test", time.Time{}, []PartitionOffset{{Partition: 0, Offset: 1}}),
+		"failed to seek the pipeline")
+}
@@ -0,0 +1,99 @@
+package ydbjobs
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// lagTimeout bounds describing the consumer, the state is polled by the jobs plugin and the RPC
+	lagTimeout = 2 * time.Second
+	// lagCacheTTL is how long the described lag, or the failure to describe it, is reused
+	lagCacheTTL = 5 * time.Second
+)
+
+// lagCache keeps the last described lag, so polling the state doesn't describe the consumer on every call.
+type lagCache struct {
+	mu        sync.Mutex
+	lag       int64
+	err       error
+	updatedAt time.Time
+}
+
+// Stats is the state of the pipeline consumer.
+type Stats struct {
+	// InFlight is the number of delivered jobs that are not acknowledged yet, including the delayed ones
+	InFlight int64
+	// Delayed is the number of delayed jobs held by the consumer
+	Delayed int64
+	// Lag is the number of messages not committed by the consumer in all topics it reads
+	Lag int64
+	// Partitions are assigned to the reader of this instance
+	Partitions []TopicPartition
+}
+
+// Stats returns the state of the pipeline consumer, the lag is described by the server and cached for a few seconds.
+// When the lag can't be described, the rest of the stats is returned with the error.
+func (d *Driver) Stats(ctx context.Context) (*Stats, error) {
+	d.mu.RLock()
+	consumer, sched := d.consumer, d.scheduler
+	d.mu.RUnlock()
+
+	return d.stats(ctx, consumer, sched)
+}
+
+func (d *Driver) stats(ctx context.Context, consumer Consumer, sched *scheduler) (*Stats, error) {
+	stats := &Stats{}
+
+	if consumer == nil {
+		return stats, nil
+	}
+
+	stats.InFlight = int64(consumer.InFlight())
+	stats.Delayed = int64(sched.Len())
+	stats.Partitions = consumer.Partitions()
+
+	lag, err := d.consumerLag(ctx)
+	stats.Lag = lag
+
+	return stats, err
+}
+
+// consumerLag returns the lag described at most lagCacheTTL ago, concurrent callers wait for a single describe.
+func (d *Driver) consumerLag(ctx context.Context) (int64, error) {
+	d.lag.mu.Lock()
+	defer d.lag.mu.Unlock()
+
+	if !d.lag.updatedAt.IsZero() && time.Since(d.lag.updatedAt) < lagCacheTTL {
+		return d.lag.lag, d.lag.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lagTimeout)
+	defer cancel()
+
+	d.lag.lag, d.lag.err = d.describeLag(ctx)
+	d.lag.updatedAt = time.Now()
+
+	return d.lag.lag, d.lag.err
+}
+
+func (d *Driver) describeLag(ctx context.Context) (int64, error) {
+	var lag int64
+
+	for _, selector := range d.Cfg.ConsumerOpts.readSelectors(d.Cfg.Topic) {
+		consumer, err := d.describeConsumer(ctx, selector.Path, d.Cfg.ConsumerOpts.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, partition := range consumer.Partitions {
+			if len(selector.Partitions) == 0 || slices.Contains(selector.Partitions, partition.ID) {
+				lag += partition.Lag
+			}
+		}
+	}
+
+	return lag, nil
+}
@@ -0,0 +1,41 @@
+package ydbjobs
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "ydb"
+)
+
+// propagator carries the W3C trace context and baggage through topic message metadata.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// metadataCarrier adapts topic message metadata to the OpenTelemetry text map carrier.
+type metadataCarrier map[string][]byte
+
+func (c metadataCarrier) Get(key string) string {
+	return string(c[key])
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	c[key] = []byte(value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func spanAttributes(topic string, extra ...attribute.KeyValue) trace.SpanStartOption {
+	return trace.WithAttributes(append([]attribute.KeyValue{
+		attribute.String("messaging.system", pluginName),
+		attribute.String("messaging.destination.name", topic),
+	}, extra...)...)
+}
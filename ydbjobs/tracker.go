@@ -0,0 +1,138 @@
+package ydbjobs
+
+import (
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"sort"
+	"sync"
+)
+
+type partitionKey struct {
+	topic     string
+	partition int64
+}
+
+type pendingMessage struct {
+	message *topicreader.Message
+	acked   bool
+}
+
+// offsetTracker keeps delivered-but-not-committed messages per partition in offset order
+// and releases only the contiguous acknowledged prefix of each partition for commit.
+type offsetTracker struct {
+	mu          sync.Mutex
+	partitions  map[partitionKey][]*pendingMessage
+	committable []*topicreader.Message
+	inFlight    int
+	notify      chan struct{}
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[partitionKey][]*pendingMessage),
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+func keyOf(msg *topicreader.Message) partitionKey {
+	return partitionKey{topic: msg.Topic(), partition: msg.PartitionID()}
+}
+
+// Track registers a delivered message. A message with an offset not greater than the last tracked one
+// means the partition was re-read from the committed offset, so the stale entries are dropped.
+func (t *offsetTracker) Track(msg *topicreader.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := keyOf(msg)
+	pending := t.partitions[key]
+
+	if len(pending) > 0 && pending[len(pending)-1].message.Offset >= msg.Offset {
+		for _, p := range pending {
+			if !p.acked {
+				t.inFlight--
+			}
+		}
+
+		pending = nil
+	}
+
+	t.partitions[key] = append(pending, &pendingMessage{message: msg})
+	t.inFlight++
+}
+
+// Ack marks the message as processed. It returns false when the message is not tracked anymore.
+func (t *offsetTracker) Ack(msg *topicreader.Message) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := keyOf(msg)
+	pending := t.partitions[key]
+
+	idx := sort.Search(len(pending), func(i int) bool {
+		return pending[i].message.Offset >= msg.Offset
+	})
+
+	if idx == len(pending) || pending[idx].message != msg {
+		return false
+	}
+
+	pending[idx].acked = true
+	t.inFlight--
+
+	n := 0
+	for n < len(pending) && pending[n].acked {
+		t.committable = append(t.committable, pending[n].message)
+		n++
+	}
+
+	if n == 0 {
+		return true
+	}
+
+	if n == len(pending) {
+		delete(t.partitions, key)
+	} else {
+		t.partitions[key] = pending[n:]
+	}
+
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// Committable returns messages ready to be committed in offset order and resets the list.
+func (t *offsetTracker) Committable() []*topicreader.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	messages := t.committable
+	t.committable = nil
+
+	return messages
+}
+
+// Notify is signaled when new messages become committable.
+func (t *offsetTracker) Notify() <-chan struct{} {
+	return t.notify
+}
+
+// InFlight returns the number of tracked messages that are not acknowledged yet.
+func (t *offsetTracker) InFlight() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.inFlight
+}
+
+// Reset forgets all tracked messages, used when the reader is restarted and they are going to be redelivered.
+func (t *offsetTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clear(t.partitions)
+	t.committable = nil
+	t.inFlight = 0
+}
@@ -0,0 +1,102 @@
+package ydbjobs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"testing"
+)
+
+func TestOffsetTrackerOrder(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	first, second, third := testMessage(0, 1, ""), testMessage(0, 2, ""), testMessage(0, 3, "")
+	other := testMessage(1, 1, "")
+
+	for _, message := range []*topicreader.Message{first, second, third, other} {
+		tracker.Track(message)
+	}
+
+	assert.Equal(t, 4, tracker.InFlight())
+
+	// the gap before the acknowledged messages holds them back
+	assert.True(t, tracker.Ack(third))
+	assert.True(t, tracker.Ack(second))
+	assert.Empty(t, tracker.Committable())
+	assert.Equal(t, 2, tracker.InFlight())
+
+	assert.True(t, tracker.Ack(other))
+	assert.Equal(t, []*topicreader.Message{other}, tracker.Committable(), "partitions are committed independently")
+
+	assert.True(t, tracker.Ack(first))
+	assert.Equal(t, []*topicreader.Message{first, second, third}, tracker.Committable())
+	assert.Empty(t, tracker.Committable())
+	assert.Zero(t, tracker.InFlight())
+
+	select {
+	case <-tracker.Notify():
+	default:
+		t.Fatal("the committable messages must be notified")
+	}
+
+	assert.False(t, tracker.Ack(first), "a committed message is not tracked anymore")
+}
+
+func TestOffsetTrackerGaps(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	first, second, third := testMessage(0, 1, ""), testMessage(0, 5, ""), testMessage(0, 9, "")
+
+	tracker.Track(first)
+	tracker.Track(second)
+	tracker.Track(third)
+
+	assert.True(t, tracker.Ack(first))
+	assert.True(t, tracker.Ack(third))
+	assert.Equal(t, []*topicreader.Message{first}, tracker.Committable())
+
+	assert.True(t, tracker.Ack(second))
+	assert.Equal(t, []*topicreader.Message{second, third}, tracker.Committable())
+
+	assert.False(t, tracker.Ack(testMessage(0, 7, "")), "an offset that was not delivered is not tracked")
+}
+
+func TestOffsetTrackerReRead(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	first, second := testMessage(0, 1, ""), testMessage(0, 2, "")
+
+	tracker.Track(first)
+	tracker.Track(second)
+	assert.True(t, tracker.Ack(second))
+
+	// the partition is read again from the committed offset
+	firstAgain := testMessage(0, 1, "")
+	tracker.Track(firstAgain)
+
+	assert.Equal(t, 1, tracker.InFlight())
+	assert.False(t, tracker.Ack(first), "messages read before the re-read are dropped")
+
+	assert.True(t, tracker.Ack(firstAgain))
+	assert.Equal(t, []*topicreader.Message{firstAgain}, tracker.Committable())
+}
+
+func TestOffsetTrackerReset(t *testing.T) {
+	tracker := newOffsetTracker()
+
+	first, second := testMessage(0, 1, ""), testMessage(0, 2, "")
+
+	tracker.Track(first)
+	tracker.Track(second)
+	assert.True(t, tracker.Ack(first))
+
+	tracker.Reset()
+
+	assert.Zero(t, tracker.InFlight())
+	assert.Empty(t, tracker.Committable())
+	assert.False(t, tracker.Ack(second))
+
+	redelivered := testMessage(0, 2, "")
+	tracker.Track(redelivered)
+	assert.True(t, tracker.Ack(redelivered))
+	assert.Equal(t, []*topicreader.Message{redelivered}, tracker.Committable())
+}
@@ -0,0 +1,121 @@
+package ydbjobs
+
+import (
+	"bytes"
+	"context"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"github.com/roadrunner-server/errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+// PushTx writes the jobs to the topic within the transaction. The jobs become visible to consumers only when
+// the transaction is committed and are discarded on rollback, so they are enqueued together with the table changes
+// made in the same transaction (e.g. inside query.Client.DoTx).
+func (d *Driver) PushTx(ctx context.Context, tx query.TxActor, msgs []jobs.Message) (err error) {
+	ctx, span := d.Tracer.Tracer(tracerName).Start(ctx, "ydb_push_tx",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		spanAttributes(d.Cfg.Topic,
+			attribute.Int("messaging.batch.message_count", len(msgs)),
+			attribute.String("db.ydb.tx_id", tx.ID()),
+		),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if err := d.checkPush(); err != nil {
+		return err
+	}
+
+	messages := make([]topicwriter.Message, len(msgs))
+	for i := range msgs {
+		messages[i], err = encode(ctx, fromJob(msgs[i]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.writeTx(ctx, tx, d.Cfg.Topic, messages)
+}
+
+// writeTx writes the messages to the topic within the transaction, they are discarded if it is rolled back.
+func (d *Driver) writeTx(ctx context.Context, tx query.TxActor, topic string, messages []topicwriter.Message) error {
+	options, err := writerCodecOptions(d.Cfg.ProducerOpts.Codec)
+	if err != nil {
+		return err
+	}
+
+	// the writer is flushed before the commit and closed when the transaction completes
+	writer, err := d.Client.StartTransactionalWriter(tx, topic,
+		append(options, topicoptions.WithWriterTrace(d.metrics.writerTrace()))...,
+	)
+	if err != nil {
+		return err
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, d.Cfg.ProducerOpts.PushTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err = writer.Write(writeCtx, messages...)
+	d.metrics.writeDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		d.metrics.writeErrors.Inc()
+
+		return errors.Errorf("failed to write jobs to %s in transaction %s: %v", topic, tx.ID(), err)
+	}
+
+	d.metrics.written.Add(float64(len(messages)))
+	d.Logger.Debug("jobs written in transaction",
+		zap.String("tx_id", tx.ID()),
+		zap.String("topic", topic),
+		zap.Int("count", len(messages)),
+	)
+
+	return nil
+}
+
+// encode builds the topic message of the job with the trace context of ctx in its metadata.
+func encode(ctx context.Context, item *Item) (topicwriter.Message, error) {
+	meta, err := item.pack()
+	if err != nil {
+		return topicwriter.Message{}, err
+	}
+
+	propagator.Inject(ctx, metadataCarrier(meta))
+
+	return topicwriter.Message{
+		Data:     bytes.NewReader(item.Payload),
+		Metadata: meta,
+	}, nil
+}
+
+// AttachAck adds the YQL statement to the transaction that commits the offset of the job, so the job result
+// is stored only together with the job acknowledgement. It requires the tx consumer mode and must be called
+// before the job is acknowledged.
+func (d *Driver) AttachAck(id string, yql string, options ...query.ExecuteOption) error {
+	d.mu.RLock()
+	c, ok := d.consumer.(*txConsumer)
+	d.mu.RUnlock()
+
+	if !ok {
+		return errors.Errorf("the pipeline does not consume in transactions, consumer_options.mode must be %s", ConsumeTx)
+	}
+
+	return c.Attach(id, yql, options...)
+}